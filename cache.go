@@ -0,0 +1,174 @@
+package traefikgraphqllimits
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheKey a SHA-256 hash of what is cached.
+type cacheKey [sha256.Size]byte
+
+// queryCacheKey hashes the query with the operation name, which selects the operation some metrics are
+// computed for.
+func queryCacheKey(graphqlRequest graphqlRequest) cacheKey {
+	hash := sha256.New()
+	hash.Write([]byte(graphqlRequest.Query))
+	hash.Write([]byte{0})
+	hash.Write([]byte(graphqlRequest.OperationName))
+
+	return hashSum(hash)
+}
+
+func hashSum(hash hash.Hash) cacheKey {
+	var key cacheKey
+	copy(key[:], hash.Sum(nil))
+
+	return key
+}
+
+type lruCacheEntry struct {
+	key     cacheKey
+	value   interface{}
+	expires time.Time
+}
+
+// lruCache a least recently used cache, safe for concurrent use. Entries older than ttl are dropped, a ttl of
+// 0 keeps them until they are evicted.
+type lruCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	order   *list.List
+
+	hits   uint64
+	misses uint64
+}
+
+func newLRUCache(size int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[cacheKey]*list.Element, size),
+		order:   list.New(),
+	}
+}
+
+func (c *lruCache) get(key cacheKey) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+
+	entry := element.Value.(*lruCacheEntry)
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		atomic.AddUint64(&c.misses, 1)
+
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	atomic.AddUint64(&c.hits, 1)
+
+	return entry.value, true
+}
+
+func (c *lruCache) add(key cacheKey, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &lruCacheEntry{key: key, value: value, expires: time.Now().Add(c.ttl)}
+
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruCacheEntry).key)
+	}
+}
+
+func (c *lruCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+// QueryCacheStats returns how many requests found the analysis of their query in the query cache, and how
+// many had to analyze it.
+func (d *GraphqlLimit) QueryCacheStats() (uint64, uint64) {
+	if d.queryCache == nil {
+		return 0, 0
+	}
+
+	return atomic.LoadUint64(&d.queryCache.hits), atomic.LoadUint64(&d.queryCache.misses)
+}
+
+// startQueryCacheStats logs the counters of QueryCacheStats every interval until ctx is done, so operators can
+// size the query cache. An empty interval disables it.
+func (d *GraphqlLimit) startQueryCacheStats(ctx context.Context, interval string) error {
+	if interval == "" {
+		return nil
+	}
+
+	duration, err := time.ParseDuration(interval)
+	if err != nil {
+		return fmt.Errorf("invalid query cache stats interval %s: %w", interval, err)
+	}
+
+	if duration <= 0 {
+		return fmt.Errorf("invalid query cache stats interval %s: must be positive", interval)
+	}
+
+	if d.queryCache == nil {
+		return nil
+	}
+
+	go func() {
+		ticker := time.NewTicker(duration)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				hits, misses := d.QueryCacheStats()
+				log.Printf("Query cache of %s: %d hits, %d misses, %d queries", d.name, hits, misses, d.queryCache.len())
+			}
+		}
+	}()
+
+	return nil
+}
+
+// parseCacheTTL parses the TTL of a cache, an empty TTL never expires.
+func parseCacheTTL(ttl string) (time.Duration, error) {
+	if ttl == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(ttl)
+}
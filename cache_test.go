@@ -0,0 +1,255 @@
+package traefikgraphqllimits
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryCacheEviction(t *testing.T) {
+	cache := newLRUCache(2, 0)
+
+	first := queryCacheKey(graphqlRequest{Query: "{ a }"})
+	second := queryCacheKey(graphqlRequest{Query: "{ b }"})
+	third := queryCacheKey(graphqlRequest{Query: "{ c }"})
+
+	cache.add(first, &queryAnalysis{})
+	cache.add(second, &queryAnalysis{})
+
+	// NOTE: Reading the first entry makes the second one the least recently used
+	if _, ok := cache.get(first); !ok {
+		t.Fatal("expected the first entry to be cached")
+	}
+
+	cache.add(third, &queryAnalysis{})
+
+	if _, ok := cache.get(second); ok {
+		t.Error("expected the second entry to be evicted")
+	}
+
+	if _, ok := cache.get(first); !ok {
+		t.Error("expected the first entry to be kept")
+	}
+
+	if _, ok := cache.get(third); !ok {
+		t.Error("expected the third entry to be cached")
+	}
+}
+
+func TestQueryCacheTTL(t *testing.T) {
+	cache := newLRUCache(10, time.Millisecond)
+
+	key := queryCacheKey(graphqlRequest{Query: "{ a }"})
+	cache.add(key, &queryAnalysis{})
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := cache.get(key); ok {
+		t.Error("expected the entry to expire")
+	}
+}
+
+func TestQueryCacheKeyOperationName(t *testing.T) {
+	query := "query A { a } query B { b }"
+
+	if queryCacheKey(graphqlRequest{Query: query, OperationName: "A"}) == queryCacheKey(graphqlRequest{Query: query, OperationName: "B"}) {
+		t.Error("expected operations of the same query to have different keys")
+	}
+}
+
+func TestGraphqlQueryCache(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DepthLimit = 2
+	cfg.QueryCacheSize = 10
+	cfg.QueryCacheTTL = "1m"
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(ctx, next, cfg, "traefik-graphql-limits-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bodies := []string{
+		deepQuery,
+		`{"query":"query { user { name } }"}`,
+		deepQuery,
+		`{"query":"query { user { name } }"}`,
+	}
+	expectedCodes := []int{http.StatusBadRequest, http.StatusOK, http.StatusBadRequest, http.StatusOK}
+
+	for i, body := range bodies {
+		if code := serveGraphqlTestRequest(t, handler, body, nil).Code; code != expectedCodes[i] {
+			t.Errorf("expected code %d for request %d, got %d", expectedCodes[i], i, code)
+		}
+	}
+
+	hits, misses := handler.(*GraphqlLimit).QueryCacheStats()
+	if hits != 2 || misses != 2 {
+		t.Errorf("expected 2 hits and 2 misses, got %d and %d", hits, misses)
+	}
+}
+
+func TestGraphqlInvalidQueryCacheTTL(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.QueryCacheSize = 10
+	cfg.QueryCacheTTL = "soon"
+
+	_, err := New(context.Background(), http.NotFoundHandler(), cfg, "traefik-graphql-limits-plugin")
+	if err == nil {
+		t.Error("expected an error for an invalid query cache TTL")
+	}
+}
+
+func TestGraphqlDenyCache(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DepthLimit = 2
+	cfg.DenyCacheSize = 10
+
+	handler, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), cfg, "traefik-graphql-limits-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	denyCache := handler.(*GraphqlLimit).denyCache
+
+	for i := 0; i < 3; i++ {
+		if code := serveGraphqlTestRequest(t, handler, deepQuery, nil).Code; code != http.StatusBadRequest {
+			t.Errorf("expected code %d, got %d", http.StatusBadRequest, code)
+		}
+	}
+
+	if code := serveGraphqlTestRequest(t, handler, `{"query":"query { user { name } }"}`, nil).Code; code != http.StatusOK {
+		t.Errorf("expected code %d, got %d", http.StatusOK, code)
+	}
+
+	if denyCache.hits != 2 || denyCache.order.Len() != 1 {
+		t.Errorf("expected 2 hits on 1 rejected body, got %d hits on %d", denyCache.hits, denyCache.order.Len())
+	}
+}
+
+func TestGraphqlDenyCacheIgnoresHeaderDependentRejections(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DenyCacheSize = 10
+	cfg.MutationProfileHeader = "X-Api-Profile"
+	cfg.MutationAllowedProfiles = []string{"admin"}
+	cfg.RestrictedMutations = []string{"deleteUser"}
+
+	handler, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), cfg, "traefik-graphql-limits-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"query":"mutation { deleteUser(id: 1) }"}`
+
+	if code := serveGraphqlTestRequest(t, handler, body, nil).Code; code != http.StatusForbidden {
+		t.Errorf("expected code %d, got %d", http.StatusForbidden, code)
+	}
+
+	if code := serveGraphqlTestRequest(t, handler, body, http.Header{"X-Api-Profile": {"admin"}}).Code; code != http.StatusOK {
+		t.Errorf("expected code %d for an allowed profile, got %d", http.StatusOK, code)
+	}
+}
+
+func TestGraphqlQueryCachePerRequestChecks(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.QueryCacheSize = 10
+	cfg.ValidateVariables = true
+	cfg.MaxStreamInitialCount = 10
+	cfg.MutationProfileHeader = "X-Api-Profile"
+	cfg.MutationAllowedProfiles = []string{"admin"}
+
+	handler, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), cfg, "traefik-graphql-limits-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := `{"query":"query GetPosts($id: ID!, $count: Int = 5) { user(id: $id) { posts @stream(initialCount: $count) { title } } }"`
+	mutation := `{"query":"mutation { deleteUser(id: 1) }"}`
+
+	// NOTE: Every request after the first of each query is checked against its cached analysis
+	tests := []struct {
+		body         string
+		header       http.Header
+		expectedCode int
+	}{
+		{query + `,"variables":{"id":1}}`, nil, http.StatusOK},
+		{query + `,"variables":{}}`, nil, http.StatusBadRequest},
+		{query + `,"variables":{"id":1,"count":100}}`, nil, http.StatusBadRequest},
+		{query + `,"variables":{"id":1,"count":10}}`, nil, http.StatusOK},
+		{mutation, http.Header{"X-Api-Profile": {"admin"}}, http.StatusOK},
+		{mutation, nil, http.StatusForbidden},
+	}
+
+	for i, test := range tests {
+		if code := serveGraphqlTestRequest(t, handler, test.body, test.header).Code; code != test.expectedCode {
+			t.Errorf("expected code %d for request %d, got %d", test.expectedCode, i, code)
+		}
+	}
+
+	if hits, misses := handler.(*GraphqlLimit).QueryCacheStats(); hits != 4 || misses != 2 {
+		t.Errorf("expected 4 hits and 2 misses, got %d and %d", hits, misses)
+	}
+}
+
+func TestGraphqlQueryCacheStatsInterval(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.QueryCacheSize = 10
+	cfg.QueryCacheStatsInterval = "never"
+
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "traefik-graphql-limits-plugin"); err == nil {
+		t.Error("expected an error for an invalid query cache stats interval")
+	}
+
+	cfg.QueryCacheStatsInterval = "0s"
+
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "traefik-graphql-limits-plugin"); err == nil {
+		t.Error("expected an error for a query cache stats interval of 0")
+	}
+}
+
+func TestGraphqlQueryCacheStatsLogged(t *testing.T) {
+	reader, writer := io.Pipe()
+	log.SetOutput(writer)
+	defer log.SetOutput(os.Stderr)
+	defer func() { _ = reader.Close() }()
+
+	cfg := CreateConfig()
+	cfg.DepthLimit = 2
+	cfg.QueryCacheSize = 10
+	cfg.QueryCacheStatsInterval = "10ms"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler, err := New(ctx, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), cfg, "traefik-graphql-limits-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		serveGraphqlTestRequest(t, handler, `{"query":"query { user { name } }"}`, nil)
+	}
+
+	// NOTE: Stats may have been logged before the requests were served
+	lines := bufio.NewReader(reader)
+	for i := 0; i < 100; i++ {
+		line, err := lines.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Contains(line, "Query cache of traefik-graphql-limits-plugin: 1 hits, 1 misses, 1 queries") {
+			return
+		}
+	}
+
+	t.Error("expected the query cache stats to be logged")
+}
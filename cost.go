@@ -0,0 +1,197 @@
+package traefikgraphqllimits
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// NOTE: Costs saturate instead of overflowing, nested lists grow the estimate exponentially
+const maxQueryCost = math.MaxInt32
+
+var slicingArguments = []string{"first", "last"}
+
+// queryCostEstimator estimates how many objects resolving a document may produce. Every field returning an
+// object costs 1 and the cost of a list field is multiplied by the number of items it is expected to return.
+// Weights and list sizes declared with @cost and @listSize in the schema take precedence over these defaults.
+// Without a schema, fields with a selection set are counted as objects and lists are unknown.
+type queryCostEstimator struct {
+	schema          *graphqlSchema
+	defaultListSize int
+	expansion       *expansionCache
+	// NOTE: Values of the request and defaults of the estimated operation, for slicing arguments given as variables
+	variables          map[string]interface{}
+	variableDefaults   map[string]ast.Value
+	dependsOnVariables bool
+}
+
+// calculateQueryCost estimates the cost of the executed operation, the most expensive one when it can not be
+// selected, reporting whether it depends on the variables because a slicing argument is a variable. The document
+// must not contain fragment cycles.
+func calculateQueryCost(
+	astDoc *ast.Document,
+	request graphqlRequest,
+	schema *graphqlSchema,
+	defaultListSize int,
+	variables map[string]interface{},
+) (int, bool) {
+	fragments := fragmentDefinitions(astDoc)
+	estimator := &queryCostEstimator{
+		schema:          schema,
+		defaultListSize: defaultListSize,
+		variables:       variables,
+	}
+
+	maxCost := 0
+
+	for _, operation := range executedOperations(astDoc, request) {
+		// NOTE: Fragments may get other variable defaults in another operation
+		estimator.expansion = newExpansionCache(fragments)
+		estimator.variableDefaults = make(map[string]ast.Value)
+		for _, variable := range operation.VariableDefinitions {
+			if variable.DefaultValue != nil {
+				estimator.variableDefaults[variable.Variable.Name.Value] = variable.DefaultValue
+			}
+		}
+
+		rootType := ""
+		if schema != nil {
+			rootType = schema.rootTypes[operation.Operation]
+		}
+
+		if cost := estimator.selectionSetCost(operation.SelectionSet, rootType); cost > maxCost {
+			maxCost = cost
+		}
+	}
+
+	return maxCost, estimator.dependsOnVariables
+}
+
+func (estimator *queryCostEstimator) selectionSetCost(selectionSet *ast.SelectionSet, typeName string) int {
+	key := typedSelectionSet{selectionSet: selectionSet, typeName: typeName}
+	if cost, ok := estimator.expansion.lookup(key); ok {
+		return cost.(int)
+	}
+
+	cost := 0
+
+	for _, collected := range estimator.expansion.collectFields(selectionSet) {
+		parentTypeName := typeName
+		if collected.typeCondition != "" {
+			parentTypeName = collected.typeCondition
+		}
+
+		cost = addCost(cost, estimator.fieldCost(collected.field, estimator.schema.field(parentTypeName, collected.field.Name.Value)))
+	}
+
+	estimator.expansion.store(key, cost)
+
+	return cost
+}
+
+func (estimator *queryCostEstimator) fieldCost(field *ast.Field, definition *schemaField) int {
+	weight := 0
+	listSize := 1
+	fieldTypeName := ""
+
+	if definition != nil {
+		fieldTypeName = definition.typeName
+		weight = estimator.weight(definition)
+
+		if definition.isList || definition.hasAssumedSize || len(definition.slicingArguments) > 0 {
+			listSize = estimator.listSize(field, definition)
+		}
+	} else if field.SelectionSet != nil {
+		weight = 1
+	}
+
+	return multiplyCost(listSize, addCost(weight, estimator.selectionSetCost(field.SelectionSet, fieldTypeName)))
+}
+
+// weight returns the weight declared by @cost on the field, or on the type it returns, and otherwise 1 for
+// objects and 0 for scalars.
+func (estimator *queryCostEstimator) weight(definition *schemaField) int {
+	if definition.hasWeight {
+		return definition.weight
+	}
+
+	if fieldType, ok := estimator.schema.types[definition.typeName]; ok {
+		if fieldType.hasWeight {
+			return fieldType.weight
+		}
+
+		if fieldType.isComposite() {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// listSize returns the number of items requested by a slicing argument, or the assumed list size when it is
+// not provided.
+func (estimator *queryCostEstimator) listSize(field *ast.Field, definition *schemaField) int {
+	fieldSlicingArguments := slicingArguments
+	if len(definition.slicingArguments) > 0 {
+		fieldSlicingArguments = definition.slicingArguments
+	}
+
+	for _, argument := range field.Arguments {
+		for _, slicingArgument := range fieldSlicingArguments {
+			if argument.Name.Value != slicingArgument {
+				continue
+			}
+
+			switch value := argument.Value.(type) {
+			case *ast.IntValue:
+				size, err := strconv.Atoi(value.Value)
+				if err == nil && size >= 0 {
+					return size
+				}
+			case *ast.Variable:
+				estimator.dependsOnVariables = true
+
+				if size, ok := estimator.variableListSize(value.Name.Value); ok {
+					return size
+				}
+			}
+		}
+	}
+
+	if definition.hasAssumedSize {
+		return definition.assumedSize
+	}
+
+	return estimator.defaultListSize
+}
+
+// variableListSize returns the number of items requested by a slicing argument given as a variable, unless the
+// variable is not provided.
+func (estimator *queryCostEstimator) variableListSize(name string) (int, bool) {
+	value, ok := estimator.variables[name]
+	if !ok {
+		if defaultValue, ok := estimator.variableDefaults[name].(*ast.IntValue); ok {
+			value = json.Number(defaultValue.Value)
+		}
+	}
+
+	return intVariable(value)
+}
+
+func addCost(a, b int) int {
+	if a > maxQueryCost-b {
+		return maxQueryCost
+	}
+
+	return a + b
+}
+
+func multiplyCost(a, b int) int {
+	if a != 0 && b > maxQueryCost/a {
+		return maxQueryCost
+	}
+
+	return a * b
+}
@@ -0,0 +1,286 @@
+package traefikgraphqllimits
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+func calculateTestQueryCost(t *testing.T, schema *graphqlSchema, query string) int {
+	t.Helper()
+
+	astDoc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cost, _ := calculateQueryCost(astDoc, graphqlRequest{}, schema, 10, nil)
+
+	return cost
+}
+
+// chainedFragmentsQuery builds a query of fragments each spreading the next one twice, expanding it spreads
+// the last fragment 2^levels times.
+func chainedFragmentsQuery(levels int) string {
+	var builder strings.Builder
+
+	builder.WriteString("query { ...F0 }\n")
+
+	for i := 0; i < levels; i++ {
+		fmt.Fprintf(&builder, "fragment F%d on Query { a { ...F%d } b { ...F%d } }\n", i, i+1, i+1)
+	}
+
+	fmt.Fprintf(&builder, "fragment F%d on Query { a b }\n", levels)
+
+	return builder.String()
+}
+
+func TestCalculateQueryCostWithoutSchema(t *testing.T) {
+	query := `
+    query GetUser {
+      user(id: 1) {
+        name
+        friends(first: 5) {
+          name
+        }
+        ...userPosts
+      }
+    }
+
+    fragment userPosts on User {
+      posts { title }
+    }
+  `
+
+	cost := calculateTestQueryCost(t, nil, query)
+	if cost != 3 {
+		t.Errorf("unexpected cost: %d", cost)
+	}
+}
+
+func TestCalculateQueryCostWithSchema(t *testing.T) {
+	schema, err := parseSchema(testSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := `
+    query GetUser {
+      user(id: 1) {
+        name
+        friends(first: 5) {
+          name
+          posts { title }
+        }
+      }
+      users { id }
+    }
+  `
+
+	// NOTE: user (1) + friends 5 * (1 + posts 10 * 1) + users 10 * 1
+	cost := calculateTestQueryCost(t, schema, query)
+	if cost != 66 {
+		t.Errorf("unexpected cost: %d", cost)
+	}
+}
+
+func TestCalculateQueryCostSaturates(t *testing.T) {
+	schema, err := parseSchema(testSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := `{ users(first: 100000) { friends(first: 100000) { friends(first: 100000) { friends(first: 100000) { id } } } } }`
+
+	cost := calculateTestQueryCost(t, schema, query)
+	if cost != maxQueryCost {
+		t.Errorf("unexpected cost: %d", cost)
+	}
+}
+
+func TestGraphqlCostLimitReached(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SchemaFile = writeTestSchema(t, testSchema)
+	cfg.CostLimit = 50
+
+	body := `
+    query GetUsers {
+      users(first: 10) {
+        friends(first: 10) {
+          name
+        }
+      }
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusBadRequest)
+}
+
+func TestGraphqlCostLimitEqual(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SchemaFile = writeTestSchema(t, testSchema)
+	cfg.CostLimit = 110
+
+	body := `
+    query GetUsers {
+      users(first: 10) {
+        friends(first: 10) {
+          name
+        }
+      }
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusOK)
+}
+
+func TestCalculateQueryCostWithCostDirectives(t *testing.T) {
+	schema, err := parseSchema(`
+    directive @cost(weight: String!) on FIELD_DEFINITION | OBJECT | SCALAR
+    directive @listSize(assumedSize: Int, slicingArguments: [String!]) on FIELD_DEFINITION
+
+    scalar Expensive @cost(weight: "3")
+
+    type Query {
+      search(limit: Int): [Result] @listSize(assumedSize: 50, slicingArguments: ["limit"]) @cost(weight: "2")
+      reports: [Report] @listSize(assumedSize: 5)
+      total: Expensive
+    }
+
+    type Result {
+      id: ID
+    }
+
+    type Report @cost(weight: 10) {
+      id: ID
+    }
+  `)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// NOTE: search 50 * 2 + reports 5 * 10 + total 3
+	cost := calculateTestQueryCost(t, schema, `{ search { id } reports { id } total }`)
+	if cost != 153 {
+		t.Errorf("unexpected cost: %d", cost)
+	}
+
+	// NOTE: search 4 * 2, the default slicing arguments are replaced by @listSize
+	cost = calculateTestQueryCost(t, schema, `{ search(limit: 4, first: 1) { id } }`)
+	if cost != 8 {
+		t.Errorf("unexpected cost: %d", cost)
+	}
+}
+
+func TestCalculateQueryCostChainedFragments(t *testing.T) {
+	cost := calculateTestQueryCost(t, nil, chainedFragmentsQuery(40))
+	if cost != maxQueryCost {
+		t.Errorf("expected the cost to saturate, got %d", cost)
+	}
+}
+
+func TestCalculateQueryCostExecutedOperation(t *testing.T) {
+	schema, err := parseSchema(testSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	astDoc, err := parser.Parse(parser.ParseParams{Source: `
+    query Small { user(id: 1) { name } }
+    query Large { users(first: 5) { friends(first: 5) { name } } }
+  `})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		operationName string
+		expected      int
+	}{
+		{"Small", 1},
+		// NOTE: users 5 * (1 + friends 5 * 1)
+		{"Large", 30},
+		// NOTE: Without a selected operation, the most expensive one is estimated instead of the sum
+		{"", 30},
+	}
+
+	for _, test := range tests {
+		if cost, _ := calculateQueryCost(astDoc, graphqlRequest{OperationName: test.operationName}, schema, 10, nil); cost != test.expected {
+			t.Errorf("expected a cost of %d for %q, got %d", test.expected, test.operationName, cost)
+		}
+	}
+}
+
+func TestCalculateQueryCostWithVariables(t *testing.T) {
+	schema, err := parseSchema(testSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	astDoc, err := parser.Parse(parser.ParseParams{Source: `query GetUsers($first: Int = 3, $last: Int) {
+    users(first: $first) { posts(last: $last) { title } }
+  }`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		variables map[string]interface{}
+		expected  int
+	}{
+		// NOTE: users 3 * (1 + posts 10 * 1), the default of $first and the default list size for $last
+		{nil, 33},
+		{map[string]interface{}{"first": json.Number("100"), "last": json.Number("2")}, 300},
+		{map[string]interface{}{"first": nil, "last": json.Number("1")}, 20},
+		{map[string]interface{}{"first": "100"}, maxQueryCost},
+		{map[string]interface{}{"first": json.Number("-1")}, maxQueryCost},
+	}
+
+	for _, test := range tests {
+		cost, dependsOnVariables := calculateQueryCost(astDoc, graphqlRequest{}, schema, 10, test.variables)
+		if cost != test.expected || !dependsOnVariables {
+			t.Errorf("unexpected cost for %v: %d", test.variables, cost)
+		}
+	}
+}
+
+func TestGraphqlCostLimitVariables(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SchemaFile = writeTestSchema(t, testSchema)
+	cfg.CostLimit = 110
+	cfg.QueryCacheSize = 10
+
+	handler, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), cfg, "traefik-graphql-limits-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := `query GetUsers($first: Int) { users(first: $first) { friends(first: 10) { name } } }`
+
+	// NOTE: Every request after the first gets its analysis from the query cache
+	tests := []struct {
+		variables    string
+		expectedCode int
+	}{
+		{`{"first":10}`, http.StatusOK},
+		{`{"first":1000000}`, http.StatusBadRequest},
+		{`{"first":10}`, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		body := `{"query":"` + query + `","variables":` + test.variables + `}`
+
+		if recorder := serveGraphqlTestRequest(t, handler, body, nil); recorder.Code != test.expectedCode {
+			t.Errorf("invalid response for %s (code: %d, body: %s)", test.variables, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	if hits, misses := handler.(*GraphqlLimit).QueryCacheStats(); hits != 2 || misses != 1 {
+		t.Errorf("expected 2 hits and 1 miss, got %d and %d", hits, misses)
+	}
+}
@@ -0,0 +1,160 @@
+package traefikgraphqllimits
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/location"
+)
+
+// limitError an error of a rejected request, before it is rendered with the configured templates.
+type limitError struct {
+	// NOTE: Name of the option of the limit, selecting the custom message template, empty when not templated
+	limitName string
+	message   string
+	// NOTE: Value of the `code` extension, optional
+	code string
+	// NOTE: Placeholder values, empty when they do not apply to the limit
+	actual string
+	limit  string
+	path   string
+	// NOTE: Response keys and source locations of the selection exceeding the limit, optional
+	responsePath []string
+	locations    []location.SourceLocation
+}
+
+// newLimitError builds the error of a limit exceeded by a count, the message format takes the actual count
+// and the limit.
+func newLimitError(limitName, code, format string, actual, limit int) limitError {
+	return limitError{
+		limitName: limitName,
+		message:   fmt.Sprintf(format, actual, limit),
+		code:      code,
+		actual:    strconv.Itoa(actual),
+		limit:     strconv.Itoa(limit),
+	}
+}
+
+// templatedLimits the names of the limits which can have a custom message template.
+var templatedLimits = []string{
+	"MaxBodyBytes", "MaxQueryLength", "MaxTokens", "DepthLimit", "BatchLimit", "NodeLimit", "DirectiveLimit",
+	"DirectivesPerLocationLimit", "CostLimit", "FieldDenyList", "RestrictedMutations", "MaxVariablesBytes",
+	"MaxVariablesDepth", "MaxListLength", "RootFieldDepthLimits", "RootFieldLimit", "BreadthLimit",
+	"ForbidIncrementalDelivery", "DeferLimit", "StreamLimit", "MaxStreamInitialCount",
+}
+
+// errorTemplates customizes the errors of rejected requests. Messages, extension values and the documentation
+// URL can use the {{actual}}, {{limit}}, {{operationName}} and {{path}} placeholders.
+type errorTemplates struct {
+	messages         map[string]string
+	extensions       map[string]string
+	documentationURL string
+}
+
+func (t *errorTemplates) validate() error {
+	var unknownLimits []string
+
+	for limitName := range t.messages {
+		if !containsString(templatedLimits, limitName) {
+			unknownLimits = append(unknownLimits, limitName)
+		}
+	}
+
+	if len(unknownLimits) > 0 {
+		sort.Strings(unknownLimits)
+		return fmt.Errorf("unknown limits %s in error messages", strings.Join(unknownLimits, ", "))
+	}
+
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sourceLocations converts the location of a node to the line and column of an error, the node has no
+// location when the document was parsed without locations.
+func sourceLocations(loc *ast.Location) []location.SourceLocation {
+	if loc == nil || loc.Source == nil {
+		return nil
+	}
+
+	return []location.SourceLocation{location.GetLocation(loc.Source, loc.Start)}
+}
+
+type graphqlError struct {
+	Code       int                       `json:"code"`
+	Message    string                    `json:"message"`
+	Locations  []location.SourceLocation `json:"locations,omitempty"`
+	Path       []string                  `json:"path,omitempty"`
+	Extensions map[string]interface{}    `json:"extensions,omitempty"`
+}
+
+// render builds the JSON body of the error response.
+func (t *errorTemplates) render(statusCode int, operationName string, limitErrors ...limitError) string {
+	graphqlErrors := make([]graphqlError, 0, len(limitErrors))
+
+	for _, limitError := range limitErrors {
+		placeholders := strings.NewReplacer(
+			"{{actual}}", limitError.actual,
+			"{{limit}}", limitError.limit,
+			"{{operationName}}", operationName,
+			"{{path}}", limitError.path,
+		)
+
+		graphqlError := graphqlError{
+			Code:      statusCode,
+			Message:   limitError.message,
+			Locations: limitError.locations,
+			Path:      limitError.responsePath,
+		}
+
+		if template, ok := t.messages[limitError.limitName]; ok && limitError.limitName != "" {
+			graphqlError.Message = placeholders.Replace(template)
+		}
+
+		extensions := make(map[string]interface{})
+		if limitError.code != "" {
+			extensions["code"] = limitError.code
+		}
+
+		for name, value := range t.extensions {
+			extensions[name] = placeholders.Replace(value)
+		}
+
+		if t.documentationURL != "" {
+			extensions["documentationUrl"] = placeholders.Replace(t.documentationURL)
+		}
+
+		if len(extensions) > 0 {
+			graphqlError.Extensions = extensions
+		}
+
+		graphqlErrors = append(graphqlErrors, graphqlError)
+	}
+
+	var body bytes.Buffer
+
+	// NOTE: Documentation URLs commonly contain characters escaped by default
+	encoder := json.NewEncoder(&body)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(map[string]interface{}{"errors": graphqlErrors}); err != nil {
+		log.Printf("Error building error response: %v", err)
+		return `{"errors":[{"code":500,"message":"Failed to build error response"}]}`
+	}
+
+	return strings.TrimSuffix(body.String(), "\n")
+}
@@ -0,0 +1,129 @@
+package traefikgraphqllimits
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorTemplatesDefaultMessage(t *testing.T) {
+	templates := &errorTemplates{}
+
+	body := templates.render(http.StatusBadRequest, "", buildGraphqlMaxDepthError(4, 3, nil, nil), buildGraphqlCostLimitError(20, 10))
+
+	expected := `{"errors":[` +
+		`{"code":400,"message":"Query has depth of 4, which exceeds max depth of 3"},` +
+		`{"code":400,"message":"Query cost of 20, which exceeds limit of 10","extensions":{"code":"COST_LIMIT_EXCEEDED"}}]}`
+	if body != expected {
+		t.Errorf("unexpected error body:\n got: %s\nwant: %s", body, expected)
+	}
+}
+
+func TestErrorTemplatesCustomMessage(t *testing.T) {
+	templates := &errorTemplates{
+		messages: map[string]string{
+			"BreadthLimit": "{{operationName}} selects {{actual}} fields in {{path}}, the limit is {{limit}}",
+		},
+		extensions:       map[string]string{"service": "gateway", "limit": "{{limit}}"},
+		documentationURL: "https://docs.example.com/limits?limit=breadth&max={{limit}}",
+	}
+
+	body := templates.render(http.StatusBadRequest, "GetUser", buildGraphqlBreadthLimitError(5, 3, []string{"user", "friends"}, nil))
+
+	expected := `{"errors":[{"code":400,"message":"GetUser selects 5 fields in user.friends, the limit is 3","path":["user","friends"],"extensions":{` +
+		`"code":"BREADTH_LIMIT_EXCEEDED","documentationUrl":"https://docs.example.com/limits?limit=breadth&max=3",` +
+		`"limit":"3","service":"gateway"}}]}`
+	if body != expected {
+		t.Errorf("unexpected error body:\n got: %s\nwant: %s", body, expected)
+	}
+}
+
+func TestGraphqlCustomErrorMessage(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DepthLimit = 2
+	cfg.ErrorMessages = map[string]string{"DepthLimit": "Operation {{operationName}} is too deep ({{actual}} > {{limit}})"}
+
+	handler, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), cfg, "traefik-graphql-limits-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"query":"query GetUser ` + deepSelection + `","operationName":"GetUser"}`
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, "http://localhost/graphql", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	expected := `"message":"Operation GetUser is too deep (3 > 2)"`
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), expected) {
+		t.Errorf("expected a %d response containing %s, got %d: %s", http.StatusBadRequest, expected, recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestGraphqlUnknownErrorMessageLimit(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ErrorMessages = map[string]string{"DepthLimt": "Too deep"}
+
+	_, err := New(context.Background(), http.NotFoundHandler(), cfg, "traefik-graphql-limits-plugin")
+	if err == nil {
+		t.Error("expected an error for an unknown limit in error messages")
+	}
+}
+
+func TestGraphqlDepthErrorPath(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DepthLimit = 2
+	cfg.IncludeLocations = true
+
+	handler, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), cfg, "traefik-graphql-limits-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"query":"query {\n  viewer {\n    friends: contacts {\n      posts { title }\n    }\n  }\n}"}`
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, "http://localhost/graphql", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	expected := `"locations":[{"line":4,"column":7}],"path":["viewer","friends","posts"]`
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), expected) {
+		t.Errorf("expected a %d response containing %s, got %d: %s", http.StatusBadRequest, expected, recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestGraphqlBreadthErrorLocations(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BreadthLimit = 2
+	cfg.IncludeLocations = true
+
+	handler, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), cfg, "traefik-graphql-limits-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"query":"query {\n  user { id name email }\n}"}`
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, "http://localhost/graphql", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	expected := `"locations":[{"line":2,"column":8}],"path":["user"]`
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), expected) {
+		t.Errorf("expected a %d response containing %s, got %d: %s", http.StatusBadRequest, expected, recorder.Code, recorder.Body.String())
+	}
+}
@@ -0,0 +1,159 @@
+package traefikgraphqllimits
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// fieldPattern a `Type.field` or `field` entry of the field deny and allow lists, both parts can be globs.
+type fieldPattern struct {
+	typePattern  string
+	fieldPattern string
+}
+
+// parseFieldPatterns parses the entries of a field list, failing on malformed globs which would never match.
+func parseFieldPatterns(entries []string) ([]fieldPattern, error) {
+	patterns := make([]fieldPattern, 0, len(entries))
+
+	for _, entry := range entries {
+		typePattern, fieldName, found := strings.Cut(entry, ".")
+		if !found {
+			typePattern, fieldName = "*", entry
+		}
+
+		if err := validateGlobs(typePattern, fieldName); err != nil {
+			return nil, fmt.Errorf("invalid entry %s: %w", entry, err)
+		}
+
+		patterns = append(patterns, fieldPattern{typePattern: typePattern, fieldPattern: fieldName})
+	}
+
+	return patterns, nil
+}
+
+// validateGlobs checks the syntax of path.Match patterns, which otherwise only fail when they are matched.
+func validateGlobs(patterns ...string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p fieldPattern) matches(typeName, fieldName string) bool {
+	typeMatched, err := path.Match(p.typePattern, typeName)
+	if err != nil || !typeMatched {
+		return false
+	}
+
+	fieldMatched, err := path.Match(p.fieldPattern, fieldName)
+
+	return err == nil && fieldMatched
+}
+
+func matchesAnyField(patterns []fieldPattern, typeName, fieldName string) bool {
+	for _, pattern := range patterns {
+		if pattern.matches(typeName, fieldName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fieldAccessChecker walks a document looking for fields which are denied, or not allowed when an allow list
+// is configured.
+type fieldAccessChecker struct {
+	denied  []fieldPattern
+	allowed []fieldPattern
+	schema  *graphqlSchema
+	// NOTE: Only selection sets without forbidden fields are stored, the first forbidden field ends the walk
+	expansion *expansionCache
+}
+
+// findForbiddenField returns the `Type.field` coordinate of the first forbidden field of the document, or an
+// empty string. Fragments are expanded and aliases ignored, so a field is matched however it is selected.
+// The type of nested fields is only known with a schema, otherwise it comes from fragment type conditions
+// and the coordinate is only the field name. The document must not contain fragment cycles.
+func findForbiddenField(astDoc *ast.Document, schema *graphqlSchema, denied, allowed []fieldPattern) string {
+	checker := &fieldAccessChecker{
+		denied:    denied,
+		allowed:   allowed,
+		schema:    schema,
+		expansion: newExpansionCache(fragmentDefinitions(astDoc)),
+	}
+
+	for _, operation := range operationDefinitions(astDoc) {
+		if coordinate := checker.forbiddenFieldIn(operation.SelectionSet, rootTypeName(schema, operation.Operation)); coordinate != "" {
+			return coordinate
+		}
+	}
+
+	return ""
+}
+
+func (checker *fieldAccessChecker) forbiddenFieldIn(selectionSet *ast.SelectionSet, typeName string) string {
+	key := typedSelectionSet{selectionSet: selectionSet, typeName: typeName}
+	if _, ok := checker.expansion.lookup(key); ok {
+		return ""
+	}
+
+	for _, collected := range checker.expansion.collectFields(selectionSet) {
+		parentTypeName := typeName
+		if collected.typeCondition != "" {
+			parentTypeName = collected.typeCondition
+		}
+
+		fieldName := collected.field.Name.Value
+
+		if matchesAnyField(checker.denied, parentTypeName, fieldName) {
+			return fieldCoordinate(parentTypeName, fieldName)
+		}
+
+		if len(checker.allowed) > 0 && fieldName != "__typename" && !matchesAnyField(checker.allowed, parentTypeName, fieldName) {
+			return fieldCoordinate(parentTypeName, fieldName)
+		}
+
+		fieldTypeName := ""
+		if definition := checker.schema.field(parentTypeName, fieldName); definition != nil {
+			fieldTypeName = definition.typeName
+		}
+
+		if coordinate := checker.forbiddenFieldIn(collected.field.SelectionSet, fieldTypeName); coordinate != "" {
+			return coordinate
+		}
+	}
+
+	checker.expansion.store(key, true)
+
+	return ""
+}
+
+func fieldCoordinate(typeName, fieldName string) string {
+	if typeName == "" {
+		return fieldName
+	}
+
+	return typeName + "." + fieldName
+}
+
+// rootTypeName returns the name of the root type of an operation, using the conventional names without a schema.
+func rootTypeName(schema *graphqlSchema, operation string) string {
+	if schema != nil {
+		return schema.rootTypes[operation]
+	}
+
+	switch operation {
+	case ast.OperationTypeMutation:
+		return "Mutation"
+	case ast.OperationTypeSubscription:
+		return "Subscription"
+	}
+
+	return "Query"
+}
@@ -0,0 +1,146 @@
+package traefikgraphqllimits
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+func findTestForbiddenField(t *testing.T, schema *graphqlSchema, denied, allowed []string, query string) string {
+	t.Helper()
+
+	astDoc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deniedFields, err := parseFieldPatterns(denied)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowedFields, err := parseFieldPatterns(allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return findForbiddenField(astDoc, schema, deniedFields, allowedFields)
+}
+
+func TestFindForbiddenFieldDenyList(t *testing.T) {
+	denied := []string{"Query.internalDebug", "Mutation.deleteAll*", "password"}
+
+	testCases := []struct {
+		query    string
+		expected string
+	}{
+		{query: `{ user { name } }`, expected: ""},
+		{query: `{ debug: internalDebug }`, expected: "Query.internalDebug"},
+		{query: `{ ...debug } fragment debug on Query { internalDebug }`, expected: "Query.internalDebug"},
+		{query: `mutation { deleteAllUsers }`, expected: "Mutation.deleteAllUsers"},
+		{query: `{ internalDebug: user { name } }`, expected: ""},
+		{query: `{ user { ... on User { secret: password } } }`, expected: "User.password"},
+		{query: `{ user { friends { password } } }`, expected: "password"},
+	}
+
+	for _, testCase := range testCases {
+		coordinate := findTestForbiddenField(t, nil, denied, nil, testCase.query)
+		if coordinate != testCase.expected {
+			t.Errorf("unexpected forbidden field for %s: got %q, want %q", testCase.query, coordinate, testCase.expected)
+		}
+	}
+}
+
+func TestFindForbiddenFieldWithSchema(t *testing.T) {
+	schema, err := parseSchema(testSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	denied := []string{"User.email"}
+
+	coordinate := findTestForbiddenField(t, schema, denied, nil, `{ users { friends { email } } }`)
+	if coordinate != "User.email" {
+		t.Errorf("unexpected forbidden field: %q", coordinate)
+	}
+}
+
+func TestFindForbiddenFieldAllowList(t *testing.T) {
+	allowed := []string{"Query.user", "name", "friends"}
+
+	coordinate := findTestForbiddenField(t, nil, nil, allowed, `{ user { __typename name friends { name } } }`)
+	if coordinate != "" {
+		t.Errorf("unexpected forbidden field: %q", coordinate)
+	}
+
+	coordinate = findTestForbiddenField(t, nil, nil, allowed, `{ user { name } users { name } }`)
+	if coordinate != "Query.users" {
+		t.Errorf("unexpected forbidden field: %q", coordinate)
+	}
+}
+
+func TestGraphqlFieldDenyListReached(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.FieldDenyList = []string{"Query.internalDebug"}
+
+	body := `
+    query Debug {
+      ...debugFields
+    }
+
+    fragment debugFields on Query {
+      debug: internalDebug
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusForbidden)
+}
+
+func TestGraphqlFieldDenyListNotReached(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.FieldDenyList = []string{"Query.internalDebug"}
+
+	body := `
+    query GetUser {
+      user(id: 1) {
+        internalDebug
+      }
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusOK)
+}
+
+func TestFindForbiddenFieldChainedFragments(t *testing.T) {
+	query := chainedFragmentsQuery(40)
+
+	if coordinate := findTestForbiddenField(t, nil, []string{"secret"}, nil, query); coordinate != "" {
+		t.Errorf("unexpected forbidden field: %s", coordinate)
+	}
+
+	if coordinate := findTestForbiddenField(t, nil, []string{"Query.b"}, nil, query); coordinate != "Query.b" {
+		t.Errorf("expected Query.b to be forbidden, got %q", coordinate)
+	}
+}
+
+func TestInvalidFieldPatterns(t *testing.T) {
+	configs := []func(cfg *Config){
+		func(cfg *Config) { cfg.FieldDenyList = []string{"Query.[internal"} },
+		func(cfg *Config) { cfg.FieldAllowList = []string{"user", "Query\\"} },
+		func(cfg *Config) {
+			cfg.MutationProfileHeader = "X-Api-Profile"
+			cfg.RestrictedMutations = []string{"delete[*"}
+		},
+	}
+
+	for _, configure := range configs {
+		cfg := CreateConfig()
+		configure(cfg)
+
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "traefik-graphql-limits-plugin"); err == nil {
+			t.Errorf("expected an error for %v, %v and %v", cfg.FieldDenyList, cfg.FieldAllowList, cfg.RestrictedMutations)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package traefikgraphqllimits
+
+import (
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// collectedField is a field selected by a selection set once fragments are expanded.
+type collectedField struct {
+	field *ast.Field
+	// NOTE: Type condition of the innermost fragment the field was selected through, empty when selected directly
+	typeCondition string
+}
+
+// typedSelectionSet a selection set with the name of the type it selects from.
+type typedSelectionSet struct {
+	selectionSet *ast.SelectionSet
+	typeName     string
+}
+
+// expansionCache expands the fragments of each selection set once, and keeps what a walker computes for a
+// selection set once its fragments are expanded. A fragment spread at many places is then walked once, chained
+// fragments each spreading the next one several times would otherwise take exponential time.
+type expansionCache struct {
+	fragments map[string]*ast.FragmentDefinition
+	fields    map[*ast.SelectionSet][]collectedField
+	// NOTE: Keyed by the walker, e.g. by typedSelectionSet when the result depends on the type
+	results map[interface{}]interface{}
+}
+
+func newExpansionCache(fragments map[string]*ast.FragmentDefinition) *expansionCache {
+	return &expansionCache{
+		fragments: fragments,
+		fields:    make(map[*ast.SelectionSet][]collectedField),
+		results:   make(map[interface{}]interface{}),
+	}
+}
+
+// collectFields returns the fields selected by a selection set like collectFields, expanding it only once.
+func (cache *expansionCache) collectFields(selectionSet *ast.SelectionSet) []collectedField {
+	fields, ok := cache.fields[selectionSet]
+	if !ok {
+		fields = collectFields(selectionSet, cache.fragments)
+		cache.fields[selectionSet] = fields
+	}
+
+	return fields
+}
+
+func (cache *expansionCache) lookup(key interface{}) (interface{}, bool) {
+	result, ok := cache.results[key]
+	return result, ok
+}
+
+func (cache *expansionCache) store(key, result interface{}) {
+	cache.results[key] = result
+}
+
+func fragmentDefinitions(astDoc *ast.Document) map[string]*ast.FragmentDefinition {
+	fragments := make(map[string]*ast.FragmentDefinition)
+
+	for _, definition := range astDoc.Definitions {
+		if fragment, ok := definition.(*ast.FragmentDefinition); ok {
+			fragments[fragment.Name.Value] = fragment
+		}
+	}
+
+	return fragments
+}
+
+func operationDefinitions(astDoc *ast.Document) []*ast.OperationDefinition {
+	var operations []*ast.OperationDefinition
+
+	for _, definition := range astDoc.Definitions {
+		if operation, ok := definition.(*ast.OperationDefinition); ok {
+			operations = append(operations, operation)
+		}
+	}
+
+	return operations
+}
+
+// hasFragmentCycle reports whether a fragment spreads itself, directly or through other fragments.
+// Such documents are invalid and would make every walker expanding fragments loop forever.
+func hasFragmentCycle(fragments map[string]*ast.FragmentDefinition) bool {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make(map[string]int, len(fragments))
+
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		switch state[name] {
+		case visiting:
+			return true
+		case visited:
+			return false
+		}
+
+		fragment, ok := fragments[name]
+		if !ok {
+			return false
+		}
+
+		state[name] = visiting
+		for _, spread := range fragmentSpreads(fragment.SelectionSet) {
+			if visit(spread) {
+				return true
+			}
+		}
+		state[name] = visited
+
+		return false
+	}
+
+	for name := range fragments {
+		if state[name] == unvisited && visit(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func fragmentSpreads(selectionSet *ast.SelectionSet) []string {
+	if selectionSet == nil {
+		return nil
+	}
+
+	var spreads []string
+
+	for _, selection := range selectionSet.Selections {
+		switch node := selection.(type) {
+		case *ast.FragmentSpread:
+			spreads = append(spreads, node.Name.Value)
+		case *ast.Field:
+			spreads = append(spreads, fragmentSpreads(node.SelectionSet)...)
+		case *ast.InlineFragment:
+			spreads = append(spreads, fragmentSpreads(node.SelectionSet)...)
+		}
+	}
+
+	return spreads
+}
+
+// collectFields flattens a selection set into the fields it selects, expanding fragment spreads and
+// inline fragments. Each named fragment is expanded at most once per selection set and unknown
+// fragments are ignored. The document must not contain fragment cycles.
+func collectFields(selectionSet *ast.SelectionSet, fragments map[string]*ast.FragmentDefinition) []collectedField {
+	return collectFieldsInto(nil, selectionSet, fragments, "", make(map[string]bool))
+}
+
+func collectFieldsInto(
+	fields []collectedField,
+	selectionSet *ast.SelectionSet,
+	fragments map[string]*ast.FragmentDefinition,
+	typeCondition string,
+	expandedFragments map[string]bool,
+) []collectedField {
+	if selectionSet == nil {
+		return fields
+	}
+
+	for _, selection := range selectionSet.Selections {
+		switch node := selection.(type) {
+		case *ast.Field:
+			fields = append(fields, collectedField{field: node, typeCondition: typeCondition})
+		case *ast.InlineFragment:
+			inlineTypeCondition := typeCondition
+			if node.TypeCondition != nil {
+				inlineTypeCondition = node.TypeCondition.Name.Value
+			}
+			fields = collectFieldsInto(fields, node.SelectionSet, fragments, inlineTypeCondition, expandedFragments)
+		case *ast.FragmentSpread:
+			fragment, ok := fragments[node.Name.Value]
+			if !ok || expandedFragments[node.Name.Value] {
+				continue
+			}
+			expandedFragments[node.Name.Value] = true
+			fields = collectFieldsInto(fields, fragment.SelectionSet, fragments, fragment.TypeCondition.Name.Value, expandedFragments)
+		}
+	}
+
+	return fields
+}
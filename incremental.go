@@ -0,0 +1,164 @@
+package traefikgraphqllimits
+
+import (
+	"encoding/json"
+
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// Directives of incremental delivery, a single operation may get many payloads with them.
+const (
+	deferDirective  = "defer"
+	streamDirective = "stream"
+)
+
+// incrementalDelivery the @defer and @stream usage of an operation or fragment definition, not including the
+// fragments it spreads.
+type incrementalDelivery struct {
+	deferCount      int
+	streamCount     int
+	maxInitialCount int
+	// NOTE: Variables given as initialCount, their value is only known with the request
+	initialCountVariables []string
+	selectionSet          *ast.SelectionSet
+}
+
+// count records the incremental delivery directives of a node of the definition.
+func (usage *incrementalDelivery) count(node interface{}) {
+	directives := directivesOf(node)
+
+	switch node.(type) {
+	case *ast.InlineFragment, *ast.FragmentSpread:
+		if findDirective(directives, deferDirective) != nil {
+			usage.deferCount++
+		}
+	case *ast.Field:
+		if directive := findDirective(directives, streamDirective); directive != nil {
+			usage.streamCount++
+
+			if initialCount, ok := intArgument(directive.Arguments, "initialCount"); ok && initialCount > usage.maxInitialCount {
+				usage.maxInitialCount = initialCount
+			}
+
+			if name := variableArgument(directive.Arguments, "initialCount"); name != "" {
+				usage.addInitialCountVariables(name)
+			}
+		}
+	}
+}
+
+func (usage *incrementalDelivery) addInitialCountVariables(names ...string) {
+	for _, name := range names {
+		if !containsString(usage.initialCountVariables, name) {
+			usage.initialCountVariables = append(usage.initialCountVariables, name)
+		}
+	}
+}
+
+// variableArgument returns the name of the variable given as an argument, or an empty string.
+func variableArgument(arguments []*ast.Argument, name string) string {
+	for _, argument := range arguments {
+		if variable, ok := argument.Value.(*ast.Variable); ok && argument.Name.Value == name {
+			return variable.Name.Value
+		}
+	}
+
+	return ""
+}
+
+// operationIncrementalDelivery adds the usage of the fragments spread by an operation, directly or through
+// other fragments, to its own usage. A fragment is counted at each place it is spread, as each of them is
+// delivered separately, and counts saturate like query costs.
+func operationIncrementalDelivery(operation *incrementalDelivery, fragments map[string]*incrementalDelivery) incrementalDelivery {
+	// NOTE: Only its results are used, keyed by fragment name
+	totals := newExpansionCache(nil)
+
+	var total func(usage *incrementalDelivery) *incrementalDelivery
+	total = func(usage *incrementalDelivery) *incrementalDelivery {
+		result := &incrementalDelivery{
+			deferCount:      usage.deferCount,
+			streamCount:     usage.streamCount,
+			maxInitialCount: usage.maxInitialCount,
+		}
+		result.addInitialCountVariables(usage.initialCountVariables...)
+
+		for _, name := range fragmentSpreads(usage.selectionSet) {
+			fragment, ok := fragments[name]
+			if !ok {
+				continue
+			}
+
+			cached, ok := totals.lookup(name)
+			if !ok {
+				// NOTE: Counted as empty while it is totaled, in case the document has fragment cycles
+				totals.store(name, &incrementalDelivery{})
+				cached = total(fragment)
+				totals.store(name, cached)
+			}
+			fragmentTotal := cached.(*incrementalDelivery)
+
+			result.deferCount = addCost(result.deferCount, fragmentTotal.deferCount)
+			result.streamCount = addCost(result.streamCount, fragmentTotal.streamCount)
+			if fragmentTotal.maxInitialCount > result.maxInitialCount {
+				result.maxInitialCount = fragmentTotal.maxInitialCount
+			}
+			result.addInitialCountVariables(fragmentTotal.initialCountVariables...)
+		}
+
+		return result
+	}
+
+	return *total(operation)
+}
+
+// addIncrementalDelivery keeps the highest usage of the operations of a document in its metrics.
+func (queryMetrics *QueryMetrics) addIncrementalDelivery(usage incrementalDelivery) {
+	if usage.deferCount > queryMetrics.deferCount {
+		queryMetrics.deferCount = usage.deferCount
+	}
+
+	if usage.streamCount > queryMetrics.streamCount {
+		queryMetrics.streamCount = usage.streamCount
+	}
+
+	if usage.maxInitialCount > queryMetrics.maxStreamInitialCount {
+		queryMetrics.maxStreamInitialCount = usage.maxInitialCount
+	}
+
+	for _, name := range usage.initialCountVariables {
+		if !containsString(queryMetrics.streamInitialCountVariables, name) {
+			queryMetrics.streamInitialCountVariables = append(queryMetrics.streamInitialCountVariables, name)
+		}
+	}
+}
+
+// intVariableDefaults returns the integer default values of the named variables in the operations of the
+// document, so they can be resolved without it.
+func intVariableDefaults(astDoc *ast.Document, names []string) map[string]json.Number {
+	defaults := make(map[string]json.Number)
+
+	for _, operation := range operationDefinitions(astDoc) {
+		for _, variable := range operation.VariableDefinitions {
+			if defaultValue, isInt := variable.DefaultValue.(*ast.IntValue); isInt && containsString(names, variable.Variable.Name.Value) {
+				defaults[variable.Variable.Name.Value] = json.Number(defaultValue.Value)
+			}
+		}
+	}
+
+	return defaults
+}
+
+// variableInitialCount resolves an initialCount given as a variable, from the request or the default value of the
+// variable. Without either, initialCount is not provided and defaults to 0.
+func variableInitialCount(defaults map[string]json.Number, variables map[string]interface{}, name string) int {
+	value, ok := variables[name]
+	if !ok {
+		if defaultValue, hasDefault := defaults[name]; hasDefault {
+			value = defaultValue
+		}
+	}
+
+	initialCount, _ := intVariable(value)
+
+	return initialCount
+}
@@ -0,0 +1,135 @@
+package traefikgraphqllimits
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+const incrementalDeliveryQuery = `
+  query GetUser {
+    user(id: 1) {
+      name
+      ... @defer { email }
+      posts @stream(initialCount: 5) { title }
+      ...friendFields @defer
+    }
+  }
+
+  query GetPosts {
+    posts @stream(initialCount: 50) { title }
+  }
+
+  fragment friendFields on User {
+    friends @stream { ...nameFields @defer }
+  }
+
+  fragment nameFields on User {
+    name
+  }
+`
+
+func TestIncrementalDeliveryMetrics(t *testing.T) {
+	astDoc, err := parser.Parse(parser.ParseParams{Source: incrementalDeliveryQuery})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queryMetrics := calculateQueryMetrics(astDoc, queryMetricsOptions{})
+
+	if queryMetrics.deferCount != 3 {
+		t.Errorf("expected 3 deferred fragments, got %d", queryMetrics.deferCount)
+	}
+
+	if queryMetrics.streamCount != 2 {
+		t.Errorf("expected 2 streamed fields, got %d", queryMetrics.streamCount)
+	}
+
+	if queryMetrics.maxStreamInitialCount != 50 {
+		t.Errorf("expected an initialCount of 50, got %d", queryMetrics.maxStreamInitialCount)
+	}
+}
+
+func TestIncrementalDeliveryMetricsPerSpread(t *testing.T) {
+	query := `
+    query GetUsers {
+      a: user(id: 1) { ...deferred }
+      b: user(id: 2) { ...deferred }
+      c: user(id: 3) { ...deferred }
+    }
+
+    fragment deferred on User {
+      ... @defer { email }
+      posts @stream(initialCount: $count) { title }
+    }
+  `
+
+	astDoc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queryMetrics := calculateQueryMetrics(astDoc, queryMetricsOptions{})
+
+	if queryMetrics.deferCount != 3 || queryMetrics.streamCount != 3 {
+		t.Errorf("expected 3 deferred fragments and streamed fields, got %d and %d", queryMetrics.deferCount, queryMetrics.streamCount)
+	}
+
+	if len(queryMetrics.streamInitialCountVariables) != 1 || queryMetrics.streamInitialCountVariables[0] != "count" {
+		t.Errorf("expected the initialCount variable, got %v", queryMetrics.streamInitialCountVariables)
+	}
+}
+
+func TestGraphqlMaxStreamInitialCountVariable(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxStreamInitialCount = 10
+
+	query := `query GetPosts($count: Int = 5) { posts @stream(initialCount: $count) { title } }`
+
+	RunGraphqlLimitsTest(t, cfg, `{"query":"`+query+`"}`, http.StatusOK)
+	RunGraphqlLimitsTest(t, cfg, `{"query":"`+query+`","variables":{"count":10}}`, http.StatusOK)
+	RunGraphqlLimitsTest(t, cfg, `{"query":"`+query+`","variables":{"count":1000000}}`, http.StatusBadRequest)
+	RunGraphqlLimitsTest(t, cfg, `{"query":"`+query+`","variables":{"count":"all"}}`, http.StatusBadRequest)
+}
+
+func TestGraphqlDeferLimit(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DeferLimit = 2
+
+	RunGraphqlLimitsTest(t, cfg, incrementalDeliveryQuery, http.StatusBadRequest)
+
+	cfg.DeferLimit = 3
+
+	RunGraphqlLimitsTest(t, cfg, incrementalDeliveryQuery, http.StatusOK)
+}
+
+func TestGraphqlStreamLimit(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.StreamLimit = 1
+
+	RunGraphqlLimitsTest(t, cfg, incrementalDeliveryQuery, http.StatusBadRequest)
+
+	cfg.StreamLimit = 2
+
+	RunGraphqlLimitsTest(t, cfg, incrementalDeliveryQuery, http.StatusOK)
+}
+
+func TestGraphqlMaxStreamInitialCount(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxStreamInitialCount = 10
+
+	RunGraphqlLimitsTest(t, cfg, incrementalDeliveryQuery, http.StatusBadRequest)
+
+	cfg.MaxStreamInitialCount = 50
+
+	RunGraphqlLimitsTest(t, cfg, incrementalDeliveryQuery, http.StatusOK)
+}
+
+func TestGraphqlForbidIncrementalDelivery(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ForbidIncrementalDelivery = true
+
+	RunGraphqlLimitsTest(t, cfg, incrementalDeliveryQuery, http.StatusBadRequest)
+	RunGraphqlLimitsTest(t, cfg, `query { user(id: 1) { name } }`, http.StatusOK)
+}
@@ -4,167 +4,784 @@ package traefikgraphqllimits
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 
+	"github.com/graphql-go/graphql/gqlerrors"
 	"github.com/graphql-go/graphql/language/ast"
 	"github.com/graphql-go/graphql/language/kinds"
+	"github.com/graphql-go/graphql/language/lexer"
 	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
 	"github.com/graphql-go/graphql/language/visitor"
 )
 
-const errorBodyReadResponse = `{
-  "errors": [
-    {
-      "code": 400,
-      "message": "Failed to read request body"
-    }
-  ]
-}`
-
-const errorGraphqlParsingResponse = `{
-  "errors": [
-    {
-      "code": 400,
-      "message": "Not a valid graphql query"
-    }
-  ]
-}`
-
-func buildGraphqlMaxDepthError(maxDepth, depthLimit int) string {
-	errorBody := fmt.Sprintf(`{
-    "errors": [
-      {
-        "code": 400,
-        "message": "Query has depth of %d, which exceeds max depth of %d"
-      }
-    ] }`, maxDepth, depthLimit)
-
-	return errorBody
-}
-
-func buildGraphqlBatchLimitError(batchCount, batchLimit int) string {
-	errorBody := fmt.Sprintf(`{
-    "errors": [
-      {
-        "code": 400,
-        "message": "Query batch limit of %d, which exceeds limit of %d"
-      }
-    ] }`, batchCount, batchLimit)
-
-	return errorBody
-}
-
-func buildGraphqlNodeLimitError(nodeCount, nodeLimit int) string {
-	errorBody := fmt.Sprintf(`{
-    "errors": [
-      {
-        "code": 400,
-        "message": "Query node limit of %d, which exceeds limit of %d"
-      }
-    ] }`, nodeCount, nodeLimit)
-
-	return errorBody
+func buildGraphqlBodyReadError() limitError {
+	return limitError{message: "Failed to read request body"}
+}
+
+func buildGraphqlAmbiguousRequestError() limitError {
+	return limitError{message: "Request has duplicate query, operationName or variables fields"}
+}
+
+// buildGraphqlParsingError builds the error of a query which could not be lexed or parsed, with the message and
+// location of the syntax error unless the details are hidden.
+func buildGraphqlParsingError(err error, hideDetails bool) limitError {
+	limitError := limitError{message: "Not a valid graphql query", code: "GRAPHQL_PARSE_FAILED"}
+
+	var syntaxError *gqlerrors.Error
+	if hideDetails || !errors.As(err, &syntaxError) {
+		return limitError
+	}
+
+	// NOTE: The first line is "Syntax Error <source> (<line>:<column>) <description>", followed by the source
+	// around the location
+	message := strings.SplitN(syntaxError.Message, "\n", 2)[0]
+	if end := strings.Index(message, ") "); strings.HasPrefix(message, "Syntax Error ") && end >= 0 {
+		message = "Syntax Error: " + message[end+2:]
+	}
+
+	limitError.message = message
+	limitError.locations = syntaxError.Locations
+
+	return limitError
+}
+
+func buildGraphqlBodyTooLargeError(maxBodyBytes int64) limitError {
+	return limitError{
+		limitName: "MaxBodyBytes",
+		message:   fmt.Sprintf("Request body exceeds max size of %d bytes", maxBodyBytes),
+		limit:     strconv.FormatInt(maxBodyBytes, 10),
+	}
+}
+
+func buildGraphqlQueryLengthError(queryLength, maxQueryLength int) limitError {
+	return newLimitError("MaxQueryLength", "", "Query length of %d bytes, which exceeds limit of %d", queryLength, maxQueryLength)
+}
+
+func buildGraphqlTokenLimitError(maxTokens int) limitError {
+	return limitError{
+		limitName: "MaxTokens",
+		message:   fmt.Sprintf("Query exceeds token limit of %d", maxTokens),
+		limit:     strconv.Itoa(maxTokens),
+	}
+}
+
+func buildGraphqlMaxDepthError(maxDepth, depthLimit int, path []string, loc *ast.Location) limitError {
+	limitError := newLimitError("DepthLimit", "", "Query has depth of %d, which exceeds max depth of %d", maxDepth, depthLimit)
+	limitError.path = strings.Join(path, ".")
+	limitError.responsePath = path
+	limitError.locations = sourceLocations(loc)
+
+	return limitError
+}
+
+func buildGraphqlBatchLimitError(batchCount, batchLimit int) limitError {
+	return newLimitError("BatchLimit", "", "Query batch limit of %d, which exceeds limit of %d", batchCount, batchLimit)
+}
+
+func buildGraphqlNodeLimitError(nodeCount, nodeLimit int) limitError {
+	return newLimitError("NodeLimit", "", "Query node limit of %d, which exceeds limit of %d", nodeCount, nodeLimit)
+}
+
+func buildGraphqlDirectiveLimitError(directiveCount, directiveLimit int) limitError {
+	return newLimitError("DirectiveLimit", "DIRECTIVE_LIMIT_EXCEEDED",
+		"Query directive count of %d, which exceeds limit of %d", directiveCount, directiveLimit)
+}
+
+func buildGraphqlDirectivesPerLocationLimitError(locationDirectiveCount, directivesPerLocationLimit int) limitError {
+	return newLimitError("DirectivesPerLocationLimit", "DIRECTIVES_PER_LOCATION_LIMIT_EXCEEDED",
+		"Query has %d directives on a single location, which exceeds limit of %d", locationDirectiveCount, directivesPerLocationLimit)
+}
+
+func buildGraphqlCostLimitError(cost, costLimit int) limitError {
+	return newLimitError("CostLimit", "COST_LIMIT_EXCEEDED", "Query cost of %d, which exceeds limit of %d", cost, costLimit)
+}
+
+func buildGraphqlFieldForbiddenError(coordinate string) limitError {
+	return limitError{
+		limitName: "FieldDenyList",
+		message:   fmt.Sprintf("Field %s is forbidden", coordinate),
+		code:      "FIELD_FORBIDDEN",
+		path:      coordinate,
+	}
+}
+
+func buildGraphqlMutationForbiddenError(fieldName string) limitError {
+	return limitError{
+		limitName: "RestrictedMutations",
+		message:   fmt.Sprintf("Mutation %s is not allowed for this client", fieldName),
+		code:      "MUTATION_FORBIDDEN",
+		path:      fieldName,
+	}
+}
+
+func buildGraphqlVariablesSizeError(variablesSize, maxVariablesBytes int) limitError {
+	return newLimitError("MaxVariablesBytes", "VARIABLES_SIZE_LIMIT_EXCEEDED",
+		"Variables size of %d bytes, which exceeds limit of %d", variablesSize, maxVariablesBytes)
+}
+
+func buildGraphqlVariablesDepthError(variablesDepth, maxVariablesDepth int) limitError {
+	return newLimitError("MaxVariablesDepth", "VARIABLES_DEPTH_LIMIT_EXCEEDED",
+		"Variables have depth of %d, which exceeds max depth of %d", variablesDepth, maxVariablesDepth)
+}
+
+func buildGraphqlListLengthError(listLength, maxListLength int) limitError {
+	return newLimitError("MaxListLength", "LIST_LENGTH_LIMIT_EXCEEDED",
+		"List of %d items, which exceeds limit of %d", listLength, maxListLength)
+}
+
+func buildGraphqlRootFieldDepthError(coordinate string, depth, depthLimit int) limitError {
+	return limitError{
+		limitName: "RootFieldDepthLimits",
+		message:   fmt.Sprintf("Root field %s has depth of %d, which exceeds max depth of %d", coordinate, depth, depthLimit),
+		code:      "ROOT_FIELD_DEPTH_LIMIT_EXCEEDED",
+		actual:    strconv.Itoa(depth),
+		limit:     strconv.Itoa(depthLimit),
+		path:      coordinate,
+	}
+}
+
+func buildGraphqlRootFieldLimitError(rootFieldCount, rootFieldLimit int) limitError {
+	return newLimitError("RootFieldLimit", "ROOT_FIELD_LIMIT_EXCEEDED",
+		"Query root field count of %d, which exceeds limit of %d", rootFieldCount, rootFieldLimit)
+}
+
+func buildGraphqlBreadthLimitError(breadth, breadthLimit int, path []string, loc *ast.Location) limitError {
+	location := "the root selection set"
+	if len(path) > 0 {
+		location = strings.Join(path, ".")
+	}
+
+	return limitError{
+		limitName: "BreadthLimit",
+		message:   fmt.Sprintf("Query selects %d fields in %s, which exceeds breadth limit of %d", breadth, location, breadthLimit),
+		code:      "BREADTH_LIMIT_EXCEEDED",
+		actual:    strconv.Itoa(breadth),
+		limit:     strconv.Itoa(breadthLimit),
+		path:      strings.Join(path, "."),
+		// NOTE: Empty for the root selection set, which has no response path
+		responsePath: path,
+		locations:    sourceLocations(loc),
+	}
+}
+
+func buildGraphqlIncrementalDeliveryForbiddenError() limitError {
+	return limitError{
+		limitName: "ForbidIncrementalDelivery",
+		message:   "Incremental delivery with @defer and @stream is not allowed",
+		code:      "INCREMENTAL_DELIVERY_FORBIDDEN",
+	}
+}
+
+func buildGraphqlDeferLimitError(deferCount, deferLimit int) limitError {
+	return newLimitError("DeferLimit", "DEFER_LIMIT_EXCEEDED",
+		"Query has %d deferred fragments, which exceeds limit of %d", deferCount, deferLimit)
+}
+
+func buildGraphqlStreamLimitError(streamCount, streamLimit int) limitError {
+	return newLimitError("StreamLimit", "STREAM_LIMIT_EXCEEDED",
+		"Query has %d streamed fields, which exceeds limit of %d", streamCount, streamLimit)
+}
+
+func buildGraphqlStreamInitialCountError(initialCount, maxInitialCount int) limitError {
+	return newLimitError("MaxStreamInitialCount", "STREAM_INITIAL_COUNT_LIMIT_EXCEEDED",
+		"Query streams with initialCount of %d, which exceeds limit of %d", initialCount, maxInitialCount)
+}
+
+func buildGraphqlValidationError(errorMessages []string) []limitError {
+	validationErrors := make([]limitError, 0, len(errorMessages))
+	for _, errorMessage := range errorMessages {
+		validationErrors = append(validationErrors, limitError{message: errorMessage, code: "GRAPHQL_VALIDATION_FAILED"})
+	}
+
+	return validationErrors
 }
 
 // QueryMetrics the query metrics for check.
 type QueryMetrics struct {
-	maxDepth   int
-	batchCount int
-	nodeCount  int
+	maxDepth              int
+	maxDepthPath          []string
+	maxDepthLocation      *ast.Location
+	batchCount            int
+	nodeCount             int
+	directiveCount        int
+	maxLocationDirectives int
+	cost                  int
+	maxListLength         int
+	rootFieldDepths       map[string]int
+	rootFieldCount        int
+	maxBreadth            int
+	maxBreadthPath        []string
+	maxBreadthLocation    *ast.Location
+	// NOTE: Incremental delivery usage of the operation using the most @defer, @stream and initialCount
+	deferCount                  int
+	streamCount                 int
+	maxStreamInitialCount       int
+	streamInitialCountVariables []string
+	streamInitialCountDefaults  map[string]json.Number
 }
 
 // CreateQueryMetrics creates the default query metrics.
 func (queryMetrics QueryMetrics) CreateQueryMetrics() QueryMetrics {
 	queryMetrics.maxDepth = 0
+	queryMetrics.maxDepthPath = nil
+	queryMetrics.maxDepthLocation = nil
 	queryMetrics.batchCount = 0
 	queryMetrics.nodeCount = 0
+	queryMetrics.directiveCount = 0
+	queryMetrics.maxLocationDirectives = 0
+	queryMetrics.cost = 0
+	queryMetrics.maxListLength = 0
+	queryMetrics.rootFieldDepths = make(map[string]int)
+	queryMetrics.rootFieldCount = 0
+	queryMetrics.maxBreadth = 0
+	queryMetrics.maxBreadthPath = nil
+	queryMetrics.maxBreadthLocation = nil
+	queryMetrics.deferCount = 0
+	queryMetrics.streamCount = 0
+	queryMetrics.maxStreamInitialCount = 0
+	queryMetrics.streamInitialCountVariables = nil
+	queryMetrics.streamInitialCountDefaults = nil
 	return queryMetrics
 }
 
+// Values of OnParseError, what to do with requests whose query could not be parsed.
+const (
+	onParseErrorReject  = "reject"
+	onParseErrorForward = "forward"
+)
+
 // Config the plugin configuration.
 type Config struct {
-	GraphQLPath string
-	DepthLimit  int
-	BatchLimit  int
-	NodeLimit   int
+	GraphQLPath                   string
+	DepthLimit                    int
+	BatchLimit                    int
+	NodeLimit                     int
+	DirectiveLimit                int
+	DirectivesPerLocationLimit    int
+	MaxBodyBytes                  int64
+	MaxTokens                     int
+	MaxQueryLength                int
+	SchemaFile                    string
+	CostLimit                     int
+	DefaultListSize               int
+	FieldDenyList                 []string
+	FieldAllowList                []string
+	MutationProfileHeader         string
+	MutationAllowedProfiles       []string
+	RestrictedMutations           []string
+	MaxVariablesBytes             int
+	MaxVariablesDepth             int
+	MaxListLength                 int
+	ValidateVariables             bool
+	IgnoreTypename                bool
+	IgnoreIntrospection           bool
+	RootFieldDepthLimits          map[string]int
+	RootFieldLimit                int
+	BreadthLimit                  int
+	BreadthMergeDuplicates        bool
+	MaxSubscriptionsPerConnection int
+	MaxSubscriptionsPerClient     int
+	SubscriptionClientHeader      string
+	SubscriptionLimitCloseCode    int
+	DeferLimit                    int
+	StreamLimit                   int
+	MaxStreamInitialCount         int
+	ForbidIncrementalDelivery     bool
+	QueryCacheSize                int
+	QueryCacheTTL                 string
+	QueryCacheStatsInterval       string
+	DenyCacheSize                 int
+	DenyCacheTTL                  string
+	ErrorMessages                 map[string]string
+	ErrorExtensions               map[string]string
+	ErrorDocumentationURL         string
+	IncludeLocations              bool
+	HideParseErrorDetails         bool
+	OnParseError                  string
+	LogRejectedQueries            bool
 }
 
 // CreateConfig creates the default plugin configuration.
 func CreateConfig() *Config {
 	return &Config{
-		GraphQLPath: "/graphql",
-		DepthLimit:  0,
-		BatchLimit:  0,
-		NodeLimit:   0,
+		GraphQLPath:                   "/graphql",
+		DepthLimit:                    0,
+		BatchLimit:                    0,
+		NodeLimit:                     0,
+		DirectiveLimit:                0,
+		DirectivesPerLocationLimit:    0,
+		MaxBodyBytes:                  0,
+		MaxTokens:                     0,
+		MaxQueryLength:                0,
+		SchemaFile:                    "",
+		CostLimit:                     0,
+		DefaultListSize:               10,
+		FieldDenyList:                 []string{},
+		FieldAllowList:                []string{},
+		MutationProfileHeader:         "",
+		MutationAllowedProfiles:       []string{},
+		RestrictedMutations:           []string{},
+		MaxVariablesBytes:             0,
+		MaxVariablesDepth:             0,
+		MaxListLength:                 0,
+		ValidateVariables:             false,
+		IgnoreTypename:                false,
+		IgnoreIntrospection:           false,
+		RootFieldDepthLimits:          map[string]int{},
+		RootFieldLimit:                0,
+		BreadthLimit:                  0,
+		BreadthMergeDuplicates:        false,
+		MaxSubscriptionsPerConnection: 0,
+		MaxSubscriptionsPerClient:     0,
+		SubscriptionClientHeader:      "",
+		SubscriptionLimitCloseCode:    4429,
+		DeferLimit:                    0,
+		StreamLimit:                   0,
+		MaxStreamInitialCount:         0,
+		ForbidIncrementalDelivery:     false,
+		QueryCacheSize:                0,
+		QueryCacheTTL:                 "",
+		QueryCacheStatsInterval:       "",
+		DenyCacheSize:                 0,
+		DenyCacheTTL:                  "",
+		ErrorMessages:                 map[string]string{},
+		ErrorExtensions:               map[string]string{},
+		ErrorDocumentationURL:         "",
+		IncludeLocations:              false,
+		HideParseErrorDetails:         false,
+		OnParseError:                  onParseErrorReject,
+		LogRejectedQueries:            false,
 	}
 }
 
 // GraphqlLimit plugin configuration structure.
 type GraphqlLimit struct {
-	next        http.Handler
-	name        string
-	graphQLPath string
-	depthLimit  int
-	batchLimit  int
-	nodeLimit   int
+	next                       http.Handler
+	name                       string
+	graphQLPath                string
+	depthLimit                 int
+	batchLimit                 int
+	nodeLimit                  int
+	directiveLimit             int
+	directivesPerLocationLimit int
+	maxBodyBytes               int64
+	maxTokens                  int
+	maxQueryLength             int
+	schema                     *graphqlSchema
+	costLimit                  int
+	defaultListSize            int
+	deniedFields               []fieldPattern
+	allowedFields              []fieldPattern
+	mutationRestriction        *mutationRestriction
+	maxVariablesBytes          int
+	maxVariablesDepth          int
+	maxListLength              int
+	validateVariables          bool
+	queryMetricsOptions        queryMetricsOptions
+	rootFieldDepthLimits       map[string]int
+	rootFieldLimit             int
+	breadthLimit               int
+	breadthMergeDuplicates     bool
+	subscriptionLimits         *subscriptionLimits
+	deferLimit                 int
+	streamLimit                int
+	maxStreamInitialCount      int
+	forbidIncrementalDelivery  bool
+	queryCache                 *lruCache
+	denyCache                  *lruCache
+	errorTemplates             *errorTemplates
+	includeLocations           bool
+	hideParseErrorDetails      bool
+	forwardParseErrors         bool
+	logRejectedQueries         bool
+}
+
+// directivesOf returns the directives attached to a node which can carry directives in an executable document.
+func directivesOf(node interface{}) []*ast.Directive {
+	switch node := node.(type) {
+	case *ast.OperationDefinition:
+		return node.Directives
+	case *ast.FragmentDefinition:
+		return node.Directives
+	case *ast.Field:
+		return node.Directives
+	case *ast.FragmentSpread:
+		return node.Directives
+	case *ast.InlineFragment:
+		return node.Directives
+	}
+
+	return nil
+}
+
+// queryMetricsOptions controls which selections are taken into account by calculateQueryMetrics.
+type queryMetricsOptions struct {
+	// NOTE: Selection sets selecting only __typename, as added by client libraries, are not counted
+	ignoreTypename bool
+	// NOTE: __schema and __type subtrees, as sent by GraphQL IDEs, are not counted
+	ignoreIntrospection bool
+	// NOTE: Used to name root types by calculateRootFieldDepths, optional
+	schema *graphqlSchema
+}
+
+func (options queryMetricsOptions) ignoresIntrospectionField(node interface{}) bool {
+	return options.ignoreIntrospection && isIntrospectionField(node)
+}
+
+func isIntrospectionField(node interface{}) bool {
+	field, ok := node.(*ast.Field)
+
+	return ok && (field.Name.Value == "__schema" || field.Name.Value == "__type")
+}
+
+// selectionSetPath returns the response keys of the fields leading to the visited selection set, and the
+// location of the field it belongs to. The path of a selection set of a fragment definition starts at the
+// fragment.
+func selectionSetPath(p visitor.VisitFuncParams) ([]string, *ast.Location) {
+	var path []string
+
+	for _, ancestor := range p.Ancestors {
+		if field, ok := ancestor.(*ast.Field); ok {
+			path = append(path, responseKey(field))
+		}
+	}
+
+	if field, ok := p.Parent.(*ast.Field); ok {
+		return append(path, responseKey(field)), field.Loc
+	}
+
+	if selectionSet, ok := p.Node.(*ast.SelectionSet); ok {
+		return path, selectionSet.Loc
+	}
+
+	return path, nil
+}
+
+func selectsOnlyTypename(selectionSet *ast.SelectionSet) bool {
+	for _, selection := range selectionSet.Selections {
+		field, ok := selection.(*ast.Field)
+		if !ok || field.Name.Value != "__typename" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// countDirectives adds the directives of the visited node to the total, and keeps the most used location.
+func (queryMetrics *QueryMetrics) countDirectives(node interface{}) {
+	locationDirectives := len(directivesOf(node))
+
+	queryMetrics.directiveCount += locationDirectives
+
+	if locationDirectives > queryMetrics.maxLocationDirectives {
+		queryMetrics.maxLocationDirectives = locationDirectives
+	}
+}
+
+// countSelectionSet counts the visited selection set as a batch or a node, and keeps the deepest one.
+func (queryMetrics *QueryMetrics) countSelectionSet(p visitor.VisitFuncParams, ignoreTypename bool) {
+	// NOTE: We do not calculate initial query depth here, so we start at -1
+	depth := -1
+
+	for _, element := range p.Path {
+		if element == kinds.SelectionSet {
+			depth++
+		}
+	}
+
+	if depth > 0 && ignoreTypename {
+		if selectionSet, ok := p.Node.(*ast.SelectionSet); ok && selectsOnlyTypename(selectionSet) {
+			return
+		}
+	}
+
+	// NOTE: Top level query is start of new batch, otherwise it is a node
+	if depth == 0 {
+		queryMetrics.batchCount++
+	} else {
+		queryMetrics.nodeCount++
+	}
+
+	if depth > queryMetrics.maxDepth {
+		queryMetrics.maxDepth = depth
+		queryMetrics.maxDepthPath, queryMetrics.maxDepthLocation = selectionSetPath(p)
+	}
 }
 
-func calculateQueryMetrics(astDoc *ast.Document) QueryMetrics {
+func calculateQueryMetrics(astDoc *ast.Document, options queryMetricsOptions) QueryMetrics {
 	queryMetrics := new(QueryMetrics).CreateQueryMetrics()
 
+	// NOTE: Incremental delivery usage of the definition being visited
+	var definitionUsage *incrementalDelivery
+	var operationUsages []*incrementalDelivery
+	fragmentUsages := make(map[string]*incrementalDelivery)
+	// NOTE: Number of ignored introspection fields enclosing the visited node
+	introspectionDepth := 0
+
+	countLocationDirectives := visitor.NamedVisitFuncs{
+		Enter: func(p visitor.VisitFuncParams) (string, interface{}) {
+			if definitionUsage != nil {
+				definitionUsage.count(p.Node)
+			}
+
+			queryMetrics.countDirectives(p.Node)
+
+			return visitor.ActionNoChange, nil
+		},
+	}
+
 	v := &visitor.VisitorOptions{
 		KindFuncMap: map[string]visitor.NamedVisitFuncs{
 			kinds.SelectionSet: {
 				Enter: func(p visitor.VisitFuncParams) (string, interface{}) {
-					// NOTE: We do not calculate initial query depth here, so we start at -1
-					depth := -1
+					// NOTE: Ignored introspection subtrees are still visited for the other metrics
+					if introspectionDepth == 0 {
+						queryMetrics.countSelectionSet(p, options.ignoreTypename)
+					}
 
-					for _, element := range p.Path {
-						if element == kinds.SelectionSet {
-							depth++
-						}
+					return visitor.ActionNoChange, nil
+				},
+			},
+			kinds.ListValue: {
+				Enter: func(p visitor.VisitFuncParams) (string, interface{}) {
+					if listValue, ok := p.Node.(*ast.ListValue); ok && len(listValue.Values) > queryMetrics.maxListLength {
+						queryMetrics.maxListLength = len(listValue.Values)
 					}
 
-					// NOTE: Top level query is start of new batch, otherwise it is a node
-					if depth == 0 {
-						queryMetrics.batchCount++
-					} else {
-						queryMetrics.nodeCount++
+					return visitor.ActionNoChange, nil
+				},
+			},
+			kinds.OperationDefinition: {
+				Enter: func(p visitor.VisitFuncParams) (string, interface{}) {
+					if operation, ok := p.Node.(*ast.OperationDefinition); ok {
+						definitionUsage = &incrementalDelivery{selectionSet: operation.SelectionSet}
+						operationUsages = append(operationUsages, definitionUsage)
 					}
 
-					if depth > queryMetrics.maxDepth {
-						queryMetrics.maxDepth = depth
+					return countLocationDirectives.Enter(p)
+				},
+			},
+			kinds.FragmentDefinition: {
+				Enter: func(p visitor.VisitFuncParams) (string, interface{}) {
+					if fragment, ok := p.Node.(*ast.FragmentDefinition); ok {
+						definitionUsage = &incrementalDelivery{selectionSet: fragment.SelectionSet}
+						fragmentUsages[fragment.Name.Value] = definitionUsage
+					}
+
+					return countLocationDirectives.Enter(p)
+				},
+			},
+			kinds.Field: {
+				Enter: func(p visitor.VisitFuncParams) (string, interface{}) {
+					if options.ignoresIntrospectionField(p.Node) {
+						introspectionDepth++
+					}
+
+					return countLocationDirectives.Enter(p)
+				},
+				Leave: func(p visitor.VisitFuncParams) (string, interface{}) {
+					if options.ignoresIntrospectionField(p.Node) {
+						introspectionDepth--
 					}
 
 					return visitor.ActionNoChange, nil
 				},
 			},
+			kinds.FragmentSpread: countLocationDirectives,
+			kinds.InlineFragment: countLocationDirectives,
 		},
 	}
 
 	_ = visitor.Visit(astDoc, v, nil)
 
+	for _, operationUsage := range operationUsages {
+		queryMetrics.addIncrementalDelivery(operationIncrementalDelivery(operationUsage, fragmentUsages))
+	}
+
+	if len(queryMetrics.streamInitialCountVariables) > 0 {
+		queryMetrics.streamInitialCountDefaults = intVariableDefaults(astDoc, queryMetrics.streamInitialCountVariables)
+	}
+
 	return queryMetrics
 }
 
+// exceedsTokenLimit lexes the query without building an AST and stops as soon as more than maxTokens
+// tokens are seen, so pathological documents are rejected before the parser has to deal with them.
+func exceedsTokenLimit(query []byte, maxTokens int) (bool, error) {
+	lex := lexer.Lex(source.NewSource(&source.Source{Body: query}))
+
+	for tokenCount := 0; tokenCount <= maxTokens; tokenCount++ {
+		token, err := lex(0)
+		if err != nil {
+			return false, err
+		}
+
+		if token.Kind == lexer.EOF {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// validateConfig checks the options which are used as they are configured.
+func validateConfig(config *Config) error {
+	if !isValidCloseCode(config.SubscriptionLimitCloseCode) {
+		return fmt.Errorf("invalid SubscriptionLimitCloseCode %d, expected 1000 to 4999 except 1004 to 1006 and 1015",
+			config.SubscriptionLimitCloseCode)
+	}
+
+	if config.OnParseError != onParseErrorReject && config.OnParseError != onParseErrorForward {
+		return fmt.Errorf("invalid OnParseError %s, expected %s or %s", config.OnParseError, onParseErrorReject, onParseErrorForward)
+	}
+
+	// NOTE: A document the parser can not read may still be executed by the service, without any access check
+	if config.OnParseError == onParseErrorForward &&
+		(len(config.FieldDenyList) > 0 || len(config.FieldAllowList) > 0 || config.MutationProfileHeader != "") {
+		return fmt.Errorf("OnParseError %s can not be used with FieldDenyList, FieldAllowList or MutationProfileHeader, "+
+			"forwarded documents would bypass them", onParseErrorForward)
+	}
+
+	if err := validateGlobs(config.RestrictedMutations...); err != nil {
+		return fmt.Errorf("invalid RestrictedMutations: %w", err)
+	}
+
+	return nil
+}
+
 // New created a new plugin.
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
-	return &GraphqlLimit{
-		next:        next,
-		name:        name,
-		graphQLPath: config.GraphQLPath,
-		depthLimit:  config.DepthLimit,
-		batchLimit:  config.BatchLimit,
-		nodeLimit:   config.NodeLimit,
-	}, nil
+	var schema *graphqlSchema
+	if config.SchemaFile != "" {
+		var err error
+		schema, err = loadSchema(config.SchemaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load schema file %s: %w", config.SchemaFile, err)
+		}
+	}
+
+	templates := &errorTemplates{
+		messages:         config.ErrorMessages,
+		extensions:       config.ErrorExtensions,
+		documentationURL: config.ErrorDocumentationURL,
+	}
+	if err := templates.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+
+	deniedFields, err := parseFieldPatterns(config.FieldDenyList)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FieldDenyList: %w", err)
+	}
+
+	allowedFields, err := parseFieldPatterns(config.FieldAllowList)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FieldAllowList: %w", err)
+	}
+
+	var queryCache *lruCache
+	if config.QueryCacheSize > 0 {
+		ttl, err := parseCacheTTL(config.QueryCacheTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query cache TTL %s: %w", config.QueryCacheTTL, err)
+		}
+
+		queryCache = newLRUCache(config.QueryCacheSize, ttl)
+	}
+
+	var denyCache *lruCache
+	if config.DenyCacheSize > 0 {
+		ttl, err := parseCacheTTL(config.DenyCacheTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deny cache TTL %s: %w", config.DenyCacheTTL, err)
+		}
+
+		denyCache = newLRUCache(config.DenyCacheSize, ttl)
+	}
+
+	limit := &GraphqlLimit{
+		next:                       next,
+		name:                       name,
+		graphQLPath:                config.GraphQLPath,
+		depthLimit:                 config.DepthLimit,
+		batchLimit:                 config.BatchLimit,
+		nodeLimit:                  config.NodeLimit,
+		directiveLimit:             config.DirectiveLimit,
+		directivesPerLocationLimit: config.DirectivesPerLocationLimit,
+		maxBodyBytes:               config.MaxBodyBytes,
+		maxTokens:                  config.MaxTokens,
+		maxQueryLength:             config.MaxQueryLength,
+		schema:                     schema,
+		costLimit:                  config.CostLimit,
+		defaultListSize:            config.DefaultListSize,
+		deniedFields:               deniedFields,
+		allowedFields:              allowedFields,
+		mutationRestriction: &mutationRestriction{
+			header:        config.MutationProfileHeader,
+			allowedValues: config.MutationAllowedProfiles,
+			fields:        config.RestrictedMutations,
+		},
+		maxVariablesBytes: config.MaxVariablesBytes,
+		maxVariablesDepth: config.MaxVariablesDepth,
+		maxListLength:     config.MaxListLength,
+		validateVariables: config.ValidateVariables,
+		queryMetricsOptions: queryMetricsOptions{
+			ignoreTypename:      config.IgnoreTypename,
+			ignoreIntrospection: config.IgnoreIntrospection,
+			schema:              schema,
+		},
+		rootFieldDepthLimits:   config.RootFieldDepthLimits,
+		rootFieldLimit:         config.RootFieldLimit,
+		breadthLimit:           config.BreadthLimit,
+		breadthMergeDuplicates: config.BreadthMergeDuplicates,
+		subscriptionLimits: &subscriptionLimits{
+			perConnection: config.MaxSubscriptionsPerConnection,
+			perClient:     config.MaxSubscriptionsPerClient,
+			clientHeader:  config.SubscriptionClientHeader,
+			closeCode:     config.SubscriptionLimitCloseCode,
+			clients:       make(map[string]int),
+		},
+		deferLimit:                config.DeferLimit,
+		streamLimit:               config.StreamLimit,
+		maxStreamInitialCount:     config.MaxStreamInitialCount,
+		forbidIncrementalDelivery: config.ForbidIncrementalDelivery,
+		queryCache:                queryCache,
+		denyCache:                 denyCache,
+		errorTemplates:            templates,
+		includeLocations:          config.IncludeLocations,
+		hideParseErrorDetails:     config.HideParseErrorDetails,
+		forwardParseErrors:        config.OnParseError == onParseErrorForward,
+		logRejectedQueries:        config.LogRejectedQueries,
+	}
+
+	if err := limit.startQueryCacheStats(ctx, config.QueryCacheStatsInterval); err != nil {
+		return nil, err
+	}
+
+	return limit, nil
 }
 
-func respondWithJSONError(rw http.ResponseWriter, json string) {
+var errBodyTooLarge = errors.New("request body too large")
+
+func respondWithJSONError(rw http.ResponseWriter, statusCode int, json string) {
 	rw.Header().Set("Content-Type", "application/json")
-	rw.WriteHeader(http.StatusBadRequest)
+	rw.WriteHeader(statusCode)
 	_, err := rw.Write([]byte(json))
 	if err != nil {
 		log.Printf("Error with response: %v", err)
@@ -175,48 +792,570 @@ func isGraphqlRequest(req *http.Request, path string) bool {
 	return req.Method == "POST" && req.URL.Path == path
 }
 
-func needToCheckLimits(depthLimit, batchLimit, nodeLimit int) bool {
-	return depthLimit > 0 || batchLimit > 0 || nodeLimit > 0
+func (d *GraphqlLimit) needToParseQuery() bool {
+	return d.hasSizeLimits() || d.hasDocumentChecks() || d.hasSelectionLimits()
 }
 
-func (d *GraphqlLimit) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	body, err := io.ReadAll(req.Body)
+// hasSizeLimits reports whether some limit applies to the depth, nodes, directives or list values of the query.
+func (d *GraphqlLimit) hasSizeLimits() bool {
+	return d.depthLimit > 0 || d.batchLimit > 0 || d.nodeLimit > 0 ||
+		d.directiveLimit > 0 || d.directivesPerLocationLimit > 0 || d.maxListLength > 0
+}
+
+// hasDocumentChecks reports whether the document is checked against the schema, its cost, the field and mutation
+// restrictions or the variables of the request.
+func (d *GraphqlLimit) hasDocumentChecks() bool {
+	return d.schema != nil || d.costLimit > 0 ||
+		len(d.deniedFields) > 0 || len(d.allowedFields) > 0 ||
+		d.mutationRestriction.isEnabled() || d.validateVariables
+}
+
+// hasSelectionLimits reports whether some limit applies to the root fields, the breadth or the incremental delivery
+// of the executed operation.
+func (d *GraphqlLimit) hasSelectionLimits() bool {
+	return len(d.rootFieldDepthLimits) > 0 || d.rootFieldLimit > 0 || d.breadthLimit > 0 ||
+		d.deferLimit > 0 || d.streamLimit > 0 || d.maxStreamInitialCount > 0 || d.forbidIncrementalDelivery
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (d *GraphqlLimit) needToReadBody() bool {
+	return d.maxBodyBytes > 0 || d.maxTokens > 0 || d.maxQueryLength > 0 ||
+		d.maxVariablesBytes > 0 || d.maxVariablesDepth > 0 || d.needToParseQuery()
+}
+
+// readBody reads the whole request body, failing with errBodyTooLarge as soon as more than
+// maxBodyBytes are received. A maxBodyBytes of 0 disables the check. The body is also written to
+// digest as it is read, when not nil.
+func readBody(req *http.Request, maxBodyBytes int64, digest hash.Hash) ([]byte, error) {
+	var reader io.Reader = req.Body
+	if digest != nil {
+		reader = io.TeeReader(reader, digest)
+	}
+
+	if maxBodyBytes <= 0 {
+		return io.ReadAll(reader)
+	}
+
+	if req.ContentLength > maxBodyBytes {
+		return nil, errBodyTooLarge
+	}
+
+	body, err := io.ReadAll(io.LimitReader(reader, maxBodyBytes+1))
 	if err != nil {
-		log.Printf("Error reading body: %v", err)
-		respondWithJSONError(rw, errorBodyReadResponse)
-		return
+		return nil, err
 	}
 
-	if isGraphqlRequest(req, d.graphQLPath) && needToCheckLimits(d.depthLimit, d.batchLimit, d.nodeLimit) {
-		params := parser.ParseParams{
-			Source: string(body),
-			Options: parser.ParseOptions{
-				NoLocation: true,
-			},
-		}
+	if int64(len(body)) > maxBodyBytes {
+		return nil, errBodyTooLarge
+	}
 
-		parseResults, err := parser.Parse(params)
+	return body, nil
+}
+
+// needToAnalyzeQuery reports whether some limit depends on the query document itself.
+func (d *GraphqlLimit) needToAnalyzeQuery() bool {
+	return d.maxTokens > 0 || d.needToParseQuery()
+}
+
+// queryAnalysis the outcome of the checks which only depend on the query and the operation name, so it can be
+// shared by every request sending them. It does not keep the document, which takes many times the size of the
+// query in memory.
+type queryAnalysis struct {
+	// NOTE: The query could not be lexed or parsed
+	parseError    error
+	exceedsTokens bool
+	// NOTE: Only read once analyzed, the analysis may be shared by concurrent requests
+	validationErrors   []string
+	forbiddenField     string
+	restrictedMutation string
+	variables          operationVariables
+	metrics            QueryMetrics
+	// NOTE: Variables are not part of the query cache key, such a cost is estimated again for each request
+	costDependsOnVariables bool
+	// NOTE: Normalized query logged when it is rejected, only with LogRejectedQueries
+	redactedQuery string
+}
+
+// analyzeQuery returns the analysis of the request query, from the query cache when it is enabled. The document
+// is only returned when the query was parsed for this request, it is nil for cached analyses and parse errors.
+func (d *GraphqlLimit) analyzeQuery(graphqlRequest graphqlRequest) (*queryAnalysis, *ast.Document) {
+	if d.queryCache == nil {
+		return d.computeQueryAnalysis(graphqlRequest)
+	}
+
+	key := queryCacheKey(graphqlRequest)
+	if analysis, ok := d.queryCache.get(key); ok {
+		return analysis.(*queryAnalysis), nil
+	}
+
+	analysis, astDoc := d.computeQueryAnalysis(graphqlRequest)
+	d.queryCache.add(key, analysis)
+
+	return analysis, astDoc
+}
+
+func (d *GraphqlLimit) parseQuery(query string) (*ast.Document, error) {
+	return parser.Parse(parser.ParseParams{
+		Source: query,
+		Options: parser.ParseOptions{
+			NoLocation: !d.includeLocations,
+		},
+	})
+}
+
+func (d *GraphqlLimit) computeQueryAnalysis(graphqlRequest graphqlRequest) (*queryAnalysis, *ast.Document) {
+	analysis := &queryAnalysis{}
+
+	if d.maxTokens > 0 {
+		exceeds, err := exceedsTokenLimit([]byte(graphqlRequest.Query), d.maxTokens)
 		if err != nil {
-			respondWithJSONError(rw, errorGraphqlParsingResponse)
-			return
+			analysis.parseError = err
+			return analysis, nil
+		}
+
+		if exceeds {
+			analysis.exceedsTokens = true
+			return analysis, nil
+		}
+	}
+
+	if !d.needToParseQuery() {
+		return analysis, nil
+	}
+
+	parseResults, err := d.parseQuery(graphqlRequest.Query)
+	if err != nil {
+		analysis.parseError = err
+		analysis.redactedQuery = unparsableQueryPlaceholder
+		return analysis, nil
+	}
+
+	if d.logRejectedQueries {
+		analysis.redactedQuery = normalizeQuery(parseResults)
+	}
+
+	if d.validateDocument(analysis, parseResults) {
+		d.analyzeDocument(analysis, parseResults, graphqlRequest)
+	}
+
+	return analysis, parseResults
+}
+
+// validateDocument records the validation errors of the document in the analysis, and reports whether it is valid.
+func (d *GraphqlLimit) validateDocument(analysis *queryAnalysis, parseResults *ast.Document) bool {
+	if hasFragmentCycle(fragmentDefinitions(parseResults)) {
+		analysis.validationErrors = []string{"Cannot spread fragment within itself."}
+		return false
+	}
+
+	if d.schema != nil {
+		analysis.validationErrors = d.schema.validate(parseResults)
+	}
+
+	return len(analysis.validationErrors) == 0
+}
+
+// analyzeDocument records the restricted fields and mutations, the variables and the metrics of a valid document.
+func (d *GraphqlLimit) analyzeDocument(analysis *queryAnalysis, parseResults *ast.Document, graphqlRequest graphqlRequest) {
+	if len(d.deniedFields) > 0 || len(d.allowedFields) > 0 {
+		analysis.forbiddenField = findForbiddenField(parseResults, d.schema, d.deniedFields, d.allowedFields)
+	}
+
+	// NOTE: Whether the client may send it depends on the headers, only the mutation is found here
+	if d.mutationRestriction.isEnabled() {
+		analysis.restrictedMutation = d.mutationRestriction.findRestrictedMutation(parseResults)
+	}
+
+	if d.validateVariables {
+		analysis.variables = extractOperationVariables(parseResults, graphqlRequest)
+	}
+
+	analysis.metrics = calculateQueryMetrics(parseResults, d.queryMetricsOptions)
+
+	if d.costLimit > 0 {
+		analysis.metrics.cost, analysis.costDependsOnVariables = calculateQueryCost(parseResults, graphqlRequest, d.schema, d.defaultListSize, nil)
+	}
+
+	if len(d.rootFieldDepthLimits) > 0 {
+		analysis.metrics.rootFieldDepths = calculateRootFieldDepths(parseResults, graphqlRequest, d.queryMetricsOptions)
+	}
+
+	if d.rootFieldLimit > 0 {
+		analysis.metrics.rootFieldCount = calculateRootFieldCount(parseResults, graphqlRequest)
+	}
+
+	if d.breadthLimit > 0 {
+		analysis.metrics.maxBreadth, analysis.metrics.maxBreadthPath, analysis.metrics.maxBreadthLocation =
+			calculateMaxBreadth(parseResults, graphqlRequest, d.breadthMergeDuplicates)
+	}
+}
+
+// limitViolation a request rejected by a limit, with the status code and body of the error response.
+type limitViolation struct {
+	statusCode int
+	errors     []limitError
+	// NOTE: Rendered from errors by checkRequest
+	body string
+	// NOTE: The same body may be allowed with other headers
+	dependsOnHeaders bool
+	// NOTE: Redacted query logged with LogRejectedQueries, empty when the query was not parsed
+	redactedQuery string
+}
+
+func badRequest(limitErrors ...limitError) *limitViolation {
+	return &limitViolation{statusCode: http.StatusBadRequest, errors: limitErrors}
+}
+
+func forbidden(limitErrors ...limitError) *limitViolation {
+	return &limitViolation{statusCode: http.StatusForbidden, errors: limitErrors}
+}
+
+// checkRequest applies the configured limits to a GraphQL request, returning nil when it is allowed.
+func (d *GraphqlLimit) checkRequest(req *http.Request, graphqlRequest graphqlRequest) *limitViolation {
+	violation := d.checkLimits(req, graphqlRequest)
+	if violation != nil {
+		violation.body = d.errorTemplates.render(violation.statusCode, graphqlRequest.OperationName, violation.errors...)
+
+		if d.logRejectedQueries {
+			redactedQuery := violation.redactedQuery
+			if redactedQuery == "" {
+				redactedQuery = unparsedQueryPlaceholder
+			}
+
+			log.Printf("Rejected query with %d: %s", violation.statusCode, redactedQuery)
+		}
+	}
+
+	return violation
+}
+
+func (d *GraphqlLimit) checkLimits(req *http.Request, graphqlRequest graphqlRequest) *limitViolation {
+	if violation := d.checkEnvelope(graphqlRequest); violation != nil {
+		return violation
+	}
+
+	if !d.needToAnalyzeQuery() {
+		return nil
+	}
+
+	analysis, parseResults := d.analyzeQuery(graphqlRequest)
+
+	violation := d.checkAnalysis(req, graphqlRequest, analysis, parseResults)
+	if violation != nil {
+		violation.redactedQuery = analysis.redactedQuery
+	}
+
+	return violation
+}
+
+// checkEnvelope applies the limits which are checked without parsing the query.
+func (d *GraphqlLimit) checkEnvelope(graphqlRequest graphqlRequest) *limitViolation {
+	if graphqlRequest.ambiguous {
+		return badRequest(buildGraphqlAmbiguousRequestError())
+	}
+
+	if d.maxQueryLength > 0 && len(graphqlRequest.Query) > d.maxQueryLength {
+		return badRequest(buildGraphqlQueryLengthError(len(graphqlRequest.Query), d.maxQueryLength))
+	}
+
+	return d.checkVariables(graphqlRequest)
+}
+
+func (d *GraphqlLimit) checkVariables(graphqlRequest graphqlRequest) *limitViolation {
+	if d.maxVariablesBytes <= 0 && d.maxVariablesDepth <= 0 && d.maxListLength <= 0 {
+		return nil
+	}
+
+	variablesMetrics, err := calculateVariablesMetrics(graphqlRequest)
+	if err != nil {
+		return badRequest(buildGraphqlValidationError([]string{"Variables must be a JSON object."})...)
+	}
+
+	if d.maxVariablesBytes > 0 && variablesMetrics.size > d.maxVariablesBytes {
+		return badRequest(buildGraphqlVariablesSizeError(variablesMetrics.size, d.maxVariablesBytes))
+	}
+
+	if d.maxVariablesDepth > 0 && variablesMetrics.maxDepth > d.maxVariablesDepth {
+		return badRequest(buildGraphqlVariablesDepthError(variablesMetrics.maxDepth, d.maxVariablesDepth))
+	}
+
+	if d.maxListLength > 0 && variablesMetrics.maxListLength > d.maxListLength {
+		return badRequest(buildGraphqlListLengthError(variablesMetrics.maxListLength, d.maxListLength))
+	}
+
+	return nil
+}
+
+// checkAnalysis applies the limits checked against the analysis of the request query. The document is nil
+// when the analysis comes from the query cache.
+func (d *GraphqlLimit) checkAnalysis(
+	req *http.Request,
+	graphqlRequest graphqlRequest,
+	analysis *queryAnalysis,
+	parseResults *ast.Document,
+) *limitViolation {
+	if analysis.parseError != nil {
+		// NOTE: Nothing else can be checked without a document, next answers with its own error
+		if d.forwardParseErrors {
+			return nil
+		}
+
+		return badRequest(buildGraphqlParsingError(analysis.parseError, d.hideParseErrorDetails))
+	}
+
+	if analysis.exceedsTokens {
+		return badRequest(buildGraphqlTokenLimitError(d.maxTokens))
+	}
+
+	if !d.needToParseQuery() {
+		return nil
+	}
+
+	if violation := d.checkDocument(req, graphqlRequest, analysis); violation != nil {
+		return violation
+	}
+
+	if violation := d.checkSizeMetrics(analysis.metrics); violation != nil {
+		return violation
+	}
+
+	if violation := d.checkCost(graphqlRequest, analysis, parseResults); violation != nil {
+		return violation
+	}
+
+	if violation := d.checkSelections(analysis.metrics); violation != nil {
+		return violation
+	}
+
+	if violation := d.checkIncrementalDelivery(graphqlRequest, analysis.metrics); violation != nil {
+		return violation
+	}
+
+	return d.checkRootFieldDepths(analysis.metrics)
+}
+
+// checkDocument applies the validation and access rules, which may depend on the variables and the headers.
+func (d *GraphqlLimit) checkDocument(req *http.Request, graphqlRequest graphqlRequest, analysis *queryAnalysis) *limitViolation {
+	if len(analysis.validationErrors) > 0 {
+		return badRequest(buildGraphqlValidationError(analysis.validationErrors)...)
+	}
+
+	if d.validateVariables {
+		if errorMessages := analysis.variables.validate(graphqlRequest); len(errorMessages) > 0 {
+			return badRequest(buildGraphqlValidationError(errorMessages)...)
+		}
+	}
+
+	if analysis.forbiddenField != "" {
+		return forbidden(buildGraphqlFieldForbiddenError(analysis.forbiddenField))
+	}
+
+	if analysis.restrictedMutation != "" && !d.mutationRestriction.isAllowedClient(req) {
+		violation := forbidden(buildGraphqlMutationForbiddenError(analysis.restrictedMutation))
+		violation.dependsOnHeaders = true
+
+		return violation
+	}
+
+	return nil
+}
+
+func (d *GraphqlLimit) checkSizeMetrics(queryMetrics QueryMetrics) *limitViolation {
+	if d.depthLimit > 0 && queryMetrics.maxDepth > d.depthLimit {
+		return badRequest(buildGraphqlMaxDepthError(queryMetrics.maxDepth, d.depthLimit, queryMetrics.maxDepthPath, queryMetrics.maxDepthLocation))
+	}
+
+	if d.batchLimit > 0 && queryMetrics.batchCount > d.batchLimit {
+		return badRequest(buildGraphqlBatchLimitError(queryMetrics.batchCount, d.batchLimit))
+	}
+
+	if d.nodeLimit > 0 && queryMetrics.nodeCount > d.nodeLimit {
+		return badRequest(buildGraphqlNodeLimitError(queryMetrics.nodeCount, d.nodeLimit))
+	}
+
+	if d.directiveLimit > 0 && queryMetrics.directiveCount > d.directiveLimit {
+		return badRequest(buildGraphqlDirectiveLimitError(queryMetrics.directiveCount, d.directiveLimit))
+	}
+
+	if d.directivesPerLocationLimit > 0 && queryMetrics.maxLocationDirectives > d.directivesPerLocationLimit {
+		return badRequest(buildGraphqlDirectivesPerLocationLimitError(queryMetrics.maxLocationDirectives, d.directivesPerLocationLimit))
+	}
+
+	return nil
+}
+
+// checkCost applies the cost limit, estimating the cost again when it depends on the variables. The document is
+// nil when the analysis comes from the query cache.
+func (d *GraphqlLimit) checkCost(graphqlRequest graphqlRequest, analysis *queryAnalysis, parseResults *ast.Document) *limitViolation {
+	if d.costLimit <= 0 {
+		return nil
+	}
+
+	cost := analysis.metrics.cost
+	if analysis.costDependsOnVariables {
+		// NOTE: Cached analyses do not keep the document, it is parsed again
+		if parseResults == nil {
+			parseResults, _ = d.parseQuery(graphqlRequest.Query)
+		}
+
+		variables, _ := graphqlRequest.decodeVariables()
+		cost, _ = calculateQueryCost(parseResults, graphqlRequest, d.schema, d.defaultListSize, variables)
+	}
+
+	if cost > d.costLimit {
+		return badRequest(buildGraphqlCostLimitError(cost, d.costLimit))
+	}
+
+	return nil
+}
+
+func (d *GraphqlLimit) checkSelections(queryMetrics QueryMetrics) *limitViolation {
+	if d.maxListLength > 0 && queryMetrics.maxListLength > d.maxListLength {
+		return badRequest(buildGraphqlListLengthError(queryMetrics.maxListLength, d.maxListLength))
+	}
+
+	if d.rootFieldLimit > 0 && queryMetrics.rootFieldCount > d.rootFieldLimit {
+		return badRequest(buildGraphqlRootFieldLimitError(queryMetrics.rootFieldCount, d.rootFieldLimit))
+	}
+
+	if d.breadthLimit > 0 && queryMetrics.maxBreadth > d.breadthLimit {
+		return badRequest(buildGraphqlBreadthLimitError(queryMetrics.maxBreadth, d.breadthLimit, queryMetrics.maxBreadthPath, queryMetrics.maxBreadthLocation))
+	}
+
+	return nil
+}
+
+func (d *GraphqlLimit) checkIncrementalDelivery(graphqlRequest graphqlRequest, queryMetrics QueryMetrics) *limitViolation {
+	if d.forbidIncrementalDelivery && queryMetrics.deferCount+queryMetrics.streamCount > 0 {
+		return badRequest(buildGraphqlIncrementalDeliveryForbiddenError())
+	}
+
+	if d.deferLimit > 0 && queryMetrics.deferCount > d.deferLimit {
+		return badRequest(buildGraphqlDeferLimitError(queryMetrics.deferCount, d.deferLimit))
+	}
+
+	if d.streamLimit > 0 && queryMetrics.streamCount > d.streamLimit {
+		return badRequest(buildGraphqlStreamLimitError(queryMetrics.streamCount, d.streamLimit))
+	}
+
+	if d.maxStreamInitialCount > 0 {
+		if initialCount := streamInitialCount(graphqlRequest, queryMetrics); initialCount > d.maxStreamInitialCount {
+			return badRequest(buildGraphqlStreamInitialCountError(initialCount, d.maxStreamInitialCount))
 		}
+	}
 
-		queryMetrics := calculateQueryMetrics(parseResults)
+	return nil
+}
+
+// streamInitialCount returns the largest initialCount of the query, resolving the variables given as initialCount.
+// Variables are not part of the query cache key, they are resolved for each request.
+func streamInitialCount(graphqlRequest graphqlRequest, queryMetrics QueryMetrics) int {
+	initialCount := queryMetrics.maxStreamInitialCount
+	if len(queryMetrics.streamInitialCountVariables) == 0 {
+		return initialCount
+	}
+
+	variables, _ := graphqlRequest.decodeVariables()
+	for _, name := range queryMetrics.streamInitialCountVariables {
+		if count := variableInitialCount(queryMetrics.streamInitialCountDefaults, variables, name); count > initialCount {
+			initialCount = count
+		}
+	}
+
+	return initialCount
+}
+
+func (d *GraphqlLimit) checkRootFieldDepths(queryMetrics QueryMetrics) *limitViolation {
+	for _, coordinate := range sortedKeys(d.rootFieldDepthLimits) {
+		depthLimit := d.rootFieldDepthLimits[coordinate]
+		if depthLimit > 0 && queryMetrics.rootFieldDepths[coordinate] > depthLimit {
+			return badRequest(buildGraphqlRootFieldDepthError(coordinate, queryMetrics.rootFieldDepths[coordinate], depthLimit))
+		}
+	}
+
+	return nil
+}
 
-		if d.depthLimit > 0 && queryMetrics.maxDepth > d.depthLimit {
-			respondWithJSONError(rw, buildGraphqlMaxDepthError(queryMetrics.maxDepth, d.depthLimit))
+func (d *GraphqlLimit) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == d.graphQLPath && isWebSocketUpgrade(req) &&
+		(d.needToReadBody() || d.subscriptionLimits.isEnabled()) {
+		// NOTE: Compressed frames could not be inspected, so extensions are not negotiated with next
+		req.Header.Del("Sec-WebSocket-Extensions")
+		d.next.ServeHTTP(&webSocketResponseWriter{ResponseWriter: rw, limit: d, req: req}, req)
+		return
+	}
+
+	// NOTE: EventSource clients can only send the operation in the query string of a GET request
+	if req.Method == http.MethodGet && req.URL.Path == d.graphQLPath && req.URL.Query().Has("query") && d.needToReadBody() {
+		if violation := d.checkRequest(req, graphqlRequestFromQueryString(req.URL.Query())); violation != nil {
+			respondWithError(rw, req, violation.statusCode, violation.body)
 			return
 		}
 
-		if d.batchLimit > 0 && queryMetrics.batchCount > d.batchLimit {
-			respondWithJSONError(rw, buildGraphqlBatchLimitError(queryMetrics.batchCount, d.batchLimit))
+		d.next.ServeHTTP(rw, req)
+		return
+	}
+
+	// NOTE: Body is only buffered when there is something to check, everything else is streamed to next
+	if !isGraphqlRequest(req, d.graphQLPath) || !d.needToReadBody() {
+		d.next.ServeHTTP(rw, req)
+		return
+	}
+
+	d.serveBody(rw, req)
+}
+
+// serveBody checks the operation sent in the body of a POST request, before forwarding the request to next.
+func (d *GraphqlLimit) serveBody(rw http.ResponseWriter, req *http.Request) {
+	// NOTE: Hashed while it is read, so rejected bodies are recognized without hashing them again
+	var digest hash.Hash
+	if d.denyCache != nil {
+		digest = sha256.New()
+	}
+
+	body, err := readBody(req, d.maxBodyBytes, digest)
+	if errors.Is(err, errBodyTooLarge) {
+		respondWithError(rw, req, http.StatusRequestEntityTooLarge,
+			d.errorTemplates.render(http.StatusRequestEntityTooLarge, "", buildGraphqlBodyTooLargeError(d.maxBodyBytes)))
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading body: %v", err)
+		respondWithError(rw, req, http.StatusBadRequest, d.errorTemplates.render(http.StatusBadRequest, "", buildGraphqlBodyReadError()))
+		return
+	}
+
+	var bodyHash cacheKey
+	if digest != nil {
+		bodyHash = hashSum(digest)
+
+		if cached, ok := d.denyCache.get(bodyHash); ok {
+			violation := cached.(*limitViolation)
+			respondWithError(rw, req, violation.statusCode, violation.body)
+			return
 		}
+	}
 
-		if d.nodeLimit > 0 && queryMetrics.nodeCount > d.nodeLimit {
-			respondWithJSONError(rw, buildGraphqlNodeLimitError(queryMetrics.nodeCount, d.nodeLimit))
+	if violation := d.checkRequest(req, parseGraphqlRequest(body)); violation != nil {
+		if digest != nil && !violation.dependsOnHeaders {
+			d.denyCache.add(bodyHash, violation)
 		}
+
+		respondWithError(rw, req, violation.statusCode, violation.body)
+		return
 	}
 
+	// NOTE: rw is not wrapped, streamed responses (SSE, multipart) are flushed by next as they are produced
 	req.Body = io.NopCloser(bytes.NewBuffer(body))
 	d.next.ServeHTTP(rw, req)
 }
@@ -65,36 +65,57 @@ func TestGraphqlLimitOtherPath(t *testing.T) {
 	}
 }
 
+// deepSelection is three levels deep, one more than the DepthLimit most tests set.
+const (
+	deepSelection = `{ user { friends { friends { name } } } }`
+	deepQuery     = `{"query":"query ` + deepSelection + `"}`
+)
+
 func RunGraphqlLimitsTest(t *testing.T, cfg *Config, body string, expectedCode int) {
 	t.Helper()
 
-	ctx := context.Background()
+	RunGraphqlLimitsTestWithHeader(t, cfg, body, nil, expectedCode)
+}
+
+func RunGraphqlLimitsTestWithHeader(t *testing.T, cfg *Config, body string, header http.Header, expectedCode int) {
+	t.Helper()
+
 	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
 
-	handler, err := New(ctx, next, cfg, "traefik-graphql-limits-plugin")
+	handler, err := New(context.Background(), next, cfg, "traefik-graphql-limits-plugin")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost/graphql", strings.NewReader(body))
-	if err != nil {
-		t.Fatal(err)
+	recorder := serveGraphqlTestRequest(t, handler, body, header)
+
+	if recorder.Code != expectedCode {
+		t.Errorf("invalid response (code: %d, body: %s)", recorder.Code, recorder.Body.String())
 	}
+}
+
+func serveGraphqlTestRequest(t *testing.T, handler http.Handler, body string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
 
 	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, newGraphqlTestRequest(t, http.MethodPost, "http://localhost/graphql", body, header))
 
-	handler.ServeHTTP(recorder, req)
+	return recorder
+}
 
-	resp := recorder.Result()
+func newGraphqlTestRequest(t *testing.T, method, target, body string, header http.Header) *http.Request {
+	t.Helper()
 
-	respBody, err := io.ReadAll(resp.Body)
+	req, err := http.NewRequestWithContext(context.Background(), method, target, strings.NewReader(body))
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if resp.StatusCode != expectedCode {
-		t.Errorf("invalid response (code: %d, body: %s)", resp.StatusCode, respBody)
+	for name, values := range header {
+		req.Header[name] = values
 	}
+
+	return req
 }
 
 func TestGraphqlLimitDepthNotSet(t *testing.T) {
@@ -443,3 +464,446 @@ func TestGraphqlNodeLimitEqual(t *testing.T) {
   `
 	RunGraphqlLimitsTest(t, cfg, body, http.StatusOK)
 }
+
+func TestGraphqlMaxBodyBytesReached(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxBodyBytes = 16
+
+	body := `
+    query GetUser($id: ID!) {
+      user(id: $id) {
+        name
+      }
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusRequestEntityTooLarge)
+}
+
+func TestGraphqlMaxBodyBytesNotReached(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxBodyBytes = 1024
+
+	body := `
+    query GetUser($id: ID!) {
+      user(id: $id) {
+        name
+      }
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusOK)
+}
+
+func TestGraphqlMaxBodyBytesOtherPathNotBuffered(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxBodyBytes = 16
+	cfg.DepthLimit = 1
+
+	ctx := context.Background()
+	body := strings.NewReader(strings.Repeat("x", 1024))
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(ctx, next, cfg, "traefik-graphql-limits-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost/api/v1", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+
+	handler.ServeHTTP(recorder, req)
+
+	if body.Len() != 1024 {
+		t.Errorf("request body was read for a non GraphQL path")
+	}
+
+	resp := recorder.Result()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("invalid  code: %d", resp.StatusCode)
+	}
+}
+
+func TestGraphqlNoLimitsNotBuffered(t *testing.T) {
+	cfg := CreateConfig()
+
+	ctx := context.Background()
+	body := strings.NewReader(strings.Repeat("x", 1024))
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(ctx, next, cfg, "traefik-graphql-limits-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost/graphql", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+
+	handler.ServeHTTP(recorder, req)
+
+	if body.Len() != 1024 {
+		t.Errorf("request body was read without any limit configured")
+	}
+
+	resp := recorder.Result()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("invalid  code: %d", resp.StatusCode)
+	}
+}
+
+func TestGraphqlTokenLimitReached(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxTokens = 10
+
+	body := `
+    query GetUser($id: ID!) {
+      user(id: $id) @a @a @a @a @a @a @a @a {
+        name
+      }
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusBadRequest)
+}
+
+func TestGraphqlTokenLimitEqual(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxTokens = 21
+
+	body := `
+    query GetUser($id: ID!) {
+      user(id: $id) {
+        name
+      }
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusOK)
+}
+
+func TestGraphqlTokenLimitInvalidToken(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxTokens = 100
+
+	body := `query { user(name: "unterminated) { name } }`
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusBadRequest)
+}
+
+func TestGraphqlParseErrorDetails(t *testing.T) {
+	tests := []struct {
+		hideDetails bool
+		expected    string
+	}{
+		{false, `{"errors":[{"code":400,"message":"Syntax Error: Unexpected )","locations":[{"line":2,"column":12}],` +
+			`"extensions":{"code":"GRAPHQL_PARSE_FAILED"}}]}`},
+		{true, `{"errors":[{"code":400,"message":"Not a valid graphql query","extensions":{"code":"GRAPHQL_PARSE_FAILED"}}]}`},
+	}
+
+	for _, test := range tests {
+		cfg := CreateConfig()
+		cfg.DepthLimit = 5
+		cfg.HideParseErrorDetails = test.hideDetails
+
+		handler, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), cfg, "traefik-graphql-limits-plugin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body := `{"query":"query {\n  user(id: ) { name }\n}"}`
+
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, "http://localhost/graphql", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusBadRequest || recorder.Body.String() != test.expected {
+			t.Errorf("unexpected response %d:\n got: %s\nwant: %s", recorder.Code, recorder.Body.String(), test.expected)
+		}
+	}
+}
+
+func TestGraphqlMaxQueryLengthReached(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxQueryLength = 16
+
+	body := `query { user { name email } }`
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusBadRequest)
+}
+
+func TestGraphqlMaxQueryLengthNotReached(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxQueryLength = 64
+
+	body := `query { user { name email } }`
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusOK)
+}
+
+func TestGraphqlDirectiveLimitReached(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DirectiveLimit = 3
+
+	body := `
+    query GetUser($id: ID!, $withEmail: Boolean!) @cached {
+      user(id: $id) {
+        name @lowercase
+        email @include(if: $withEmail)
+        ... on User @defer {
+          phone
+        }
+      }
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusBadRequest)
+}
+
+func TestGraphqlDirectiveLimitEqual(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DirectiveLimit = 4
+
+	body := `
+    query GetUser($id: ID!, $withEmail: Boolean!) @cached {
+      user(id: $id) {
+        name @lowercase
+        email @include(if: $withEmail)
+        ... on User @defer {
+          phone
+        }
+      }
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusOK)
+}
+
+func TestGraphqlDirectivesPerLocationLimitReached(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DirectivesPerLocationLimit = 2
+
+	body := `
+    query GetUser($id: ID!) {
+      user(id: $id) {
+        name @a @a @a
+      }
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusBadRequest)
+}
+
+func TestGraphqlDirectivesPerLocationLimitNotReached(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DirectivesPerLocationLimit = 2
+
+	body := `
+    query GetUser($id: ID!) @a @b {
+      user(id: $id) @a @b {
+        name @a @b
+        ...userFields @a @b
+      }
+    }
+
+    fragment userFields on User @a @b {
+      email @a @b
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusOK)
+}
+
+func TestGraphqlIgnoreTypename(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DepthLimit = 1
+	cfg.NodeLimit = 1
+	cfg.IgnoreTypename = true
+
+	body := `
+    query GetUser($id: ID!) {
+      user(id: $id) {
+        __typename
+        name
+        friend {
+          __typename
+        }
+      }
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusOK)
+
+	cfg.IgnoreTypename = false
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusBadRequest)
+}
+
+func TestGraphqlIgnoreIntrospection(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DepthLimit = 2
+	cfg.IgnoreIntrospection = true
+
+	body := `
+    query IntrospectionQuery {
+      __schema {
+        types {
+          fields {
+            type {
+              name
+            }
+          }
+        }
+      }
+      user(id: 1) {
+        name
+      }
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusOK)
+
+	cfg.IgnoreIntrospection = false
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusBadRequest)
+}
+
+func TestGraphqlIgnoreIntrospectionOtherLimits(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.IgnoreIntrospection = true
+	cfg.DirectiveLimit = 5
+
+	RunGraphqlLimitsTest(t, cfg, `{ __type(name: "Query") { name @a @a @a @a @a @a } }`, http.StatusBadRequest)
+
+	cfg = CreateConfig()
+	cfg.IgnoreIntrospection = true
+	cfg.MaxListLength = 5
+
+	RunGraphqlLimitsTest(t, cfg, `{ __schema { types(ids: [1, 2, 3, 4, 5, 6]) { name } } }`, http.StatusBadRequest)
+}
+
+func TestGraphqlRootFieldDepthLimits(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DepthLimit = 4
+	cfg.RootFieldDepthLimits = map[string]int{
+		"Query.viewer": 4,
+		"Query.search": 1,
+	}
+
+	body := `
+    query Home {
+      viewer {
+        friends {
+          posts {
+            comments {
+              text
+            }
+          }
+        }
+      }
+      search(term: "graphql") {
+        title
+      }
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusOK)
+
+	body = `
+    query Home {
+      viewer {
+        name
+      }
+      search(term: "graphql") {
+        author {
+          name
+        }
+      }
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusBadRequest)
+}
+
+func TestGraphqlOnParseErrorForward(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DepthLimit = 2
+	cfg.OnParseError = "forward"
+	cfg.QueryCacheSize = 10
+	cfg.DenyCacheSize = 10
+
+	var forwarded []string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		forwarded = append(forwarded, string(body))
+	})
+
+	handler, err := New(context.Background(), next, cfg, "traefik-graphql-limits-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bodies := []string{"name=value&other=1", "name=value&other=1", deepQuery}
+	codes := []int{http.StatusOK, http.StatusOK, http.StatusBadRequest}
+
+	for i, body := range bodies {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, "http://localhost/graphql", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != codes[i] {
+			t.Errorf("invalid response (code: %d, body: %s)", recorder.Code, recorder.Body.String())
+		}
+	}
+
+	if len(forwarded) != 2 || forwarded[0] != bodies[0] || forwarded[1] != bodies[1] {
+		t.Errorf("expected the unparsable bodies to be forwarded unmodified, got %q", forwarded)
+	}
+}
+
+func TestGraphqlInvalidOnParseError(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.OnParseError = "ignore"
+
+	_, err := New(context.Background(), http.NotFoundHandler(), cfg, "traefik-graphql-limits-plugin")
+	if err == nil {
+		t.Error("expected an error for an invalid OnParseError")
+	}
+}
+
+func TestGraphqlOnParseErrorForwardWithAccessRules(t *testing.T) {
+	configs := []func(cfg *Config){
+		func(cfg *Config) { cfg.FieldDenyList = []string{"Query.internalDebug"} },
+		func(cfg *Config) { cfg.FieldAllowList = []string{"Query.user"} },
+		func(cfg *Config) { cfg.MutationProfileHeader = "X-Api-Profile" },
+	}
+
+	for _, configure := range configs {
+		cfg := CreateConfig()
+		cfg.OnParseError = "forward"
+		configure(cfg)
+
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "traefik-graphql-limits-plugin"); err == nil {
+			t.Errorf("expected an error for OnParseError forward with %v, %v and %q",
+				cfg.FieldDenyList, cfg.FieldAllowList, cfg.MutationProfileHeader)
+		}
+	}
+}
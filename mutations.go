@@ -0,0 +1,66 @@
+package traefikgraphqllimits
+
+import (
+	"net/http"
+	"path"
+
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// mutationRestriction rejects mutations from clients which do not send one of the allowed values in the
+// profile header, typically set by an authentication middleware from the API key or token claims. The header
+// is trusted as received, that middleware has to overwrite or strip the value sent by the client.
+type mutationRestriction struct {
+	header        string
+	allowedValues []string
+	// NOTE: Root field globs which are restricted, every mutation is restricted when empty
+	fields []string
+}
+
+func (restriction *mutationRestriction) isEnabled() bool {
+	return restriction.header != ""
+}
+
+func (restriction *mutationRestriction) isAllowedClient(req *http.Request) bool {
+	for _, value := range req.Header.Values(restriction.header) {
+		for _, allowedValue := range restriction.allowedValues {
+			if value == allowedValue {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// findRestrictedMutation returns the first restricted mutation root field of the document, or an empty string.
+// When every mutation is restricted, the root field is only used to report the violation. The document must
+// not contain fragment cycles.
+func (restriction *mutationRestriction) findRestrictedMutation(astDoc *ast.Document) string {
+	fragments := fragmentDefinitions(astDoc)
+
+	for _, operation := range operationDefinitions(astDoc) {
+		if operation.Operation != ast.OperationTypeMutation {
+			continue
+		}
+
+		for _, collected := range collectFields(operation.SelectionSet, fragments) {
+			fieldName := collected.field.Name.Value
+			if len(restriction.fields) == 0 || restriction.isRestrictedField(fieldName) {
+				return fieldName
+			}
+		}
+	}
+
+	return ""
+}
+
+func (restriction *mutationRestriction) isRestrictedField(fieldName string) bool {
+	for _, pattern := range restriction.fields {
+		if matched, err := path.Match(pattern, fieldName); err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,31 @@
+package traefikgraphqllimits
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGraphqlMutationRestriction(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MutationProfileHeader = "X-Api-Profile"
+	cfg.MutationAllowedProfiles = []string{"read-write"}
+
+	mutation := `mutation { ...deleteUser } fragment deleteUser on Mutation { deleteUser(id: 1) }`
+	query := `query { user(id: 1) { name } }`
+
+	RunGraphqlLimitsTest(t, cfg, mutation, http.StatusForbidden)
+	RunGraphqlLimitsTestWithHeader(t, cfg, mutation, http.Header{"X-Api-Profile": {"read-only"}}, http.StatusForbidden)
+	RunGraphqlLimitsTestWithHeader(t, cfg, mutation, http.Header{"X-Api-Profile": {"read-write"}}, http.StatusOK)
+	RunGraphqlLimitsTest(t, cfg, query, http.StatusOK)
+}
+
+func TestGraphqlRestrictedMutations(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MutationProfileHeader = "X-Api-Profile"
+	cfg.MutationAllowedProfiles = []string{"admin"}
+	cfg.RestrictedMutations = []string{"delete*"}
+
+	RunGraphqlLimitsTest(t, cfg, `mutation { likePost(id: 1) }`, http.StatusOK)
+	RunGraphqlLimitsTest(t, cfg, `mutation { likePost(id: 1) remove: deleteUser(id: 1) }`, http.StatusForbidden)
+	RunGraphqlLimitsTestWithHeader(t, cfg, `mutation { deleteUser(id: 1) }`, http.Header{"X-Api-Profile": {"admin"}}, http.StatusOK)
+}
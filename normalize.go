@@ -0,0 +1,195 @@
+package traefikgraphqllimits
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// Placeholders used instead of literal values in a normalized query.
+const (
+	normalizedStringPlaceholder = `""`
+	normalizedNumberPlaceholder = "0"
+	normalizedListPlaceholder   = "[]"
+	normalizedObjectPlaceholder = "{}"
+	// NOTE: Logged instead of queries which can not be redacted, because they can not be parsed or were
+	// rejected before being parsed so as not to parse them
+	unparsableQueryPlaceholder = "<unparsable query>"
+	unparsedQueryPlaceholder   = "<query not parsed>"
+)
+
+// normalizeQuery reprints the document on a single line with every string, number, list and object
+// literal replaced by a placeholder. Definitions, selections, arguments and directives are sorted, so
+// equivalent documents produce the same output, which is safe to log, use as a metrics label or hash.
+func normalizeQuery(astDoc *ast.Document) string {
+	definitions := make([]string, 0, len(astDoc.Definitions))
+
+	for _, definition := range astDoc.Definitions {
+		switch node := definition.(type) {
+		case *ast.OperationDefinition:
+			definitions = append(definitions, normalizeOperationDefinition(node))
+		case *ast.FragmentDefinition:
+			definitions = append(definitions, normalizeFragmentDefinition(node))
+		}
+	}
+
+	sort.Strings(definitions)
+
+	return strings.Join(definitions, " ")
+}
+
+func normalizeOperationDefinition(operation *ast.OperationDefinition) string {
+	var builder strings.Builder
+
+	builder.WriteString(operation.Operation)
+
+	if operation.Name != nil {
+		builder.WriteString(" " + operation.Name.Value)
+	}
+
+	if len(operation.VariableDefinitions) > 0 {
+		variables := make([]string, 0, len(operation.VariableDefinitions))
+		for _, variable := range operation.VariableDefinitions {
+			variables = append(variables, normalizeVariableDefinition(variable))
+		}
+		sort.Strings(variables)
+
+		builder.WriteString("(" + strings.Join(variables, ", ") + ")")
+	}
+
+	builder.WriteString(normalizeDirectives(operation.Directives))
+	builder.WriteString(" " + normalizeSelectionSet(operation.SelectionSet))
+
+	return builder.String()
+}
+
+func normalizeFragmentDefinition(fragment *ast.FragmentDefinition) string {
+	return "fragment " + fragment.Name.Value +
+		" on " + fragment.TypeCondition.Name.Value +
+		normalizeDirectives(fragment.Directives) +
+		" " + normalizeSelectionSet(fragment.SelectionSet)
+}
+
+func normalizeVariableDefinition(variable *ast.VariableDefinition) string {
+	normalized := "$" + variable.Variable.Name.Value + ": " + normalizeType(variable.Type)
+
+	if variable.DefaultValue != nil {
+		normalized += " = " + normalizeValue(variable.DefaultValue)
+	}
+
+	return normalized
+}
+
+func normalizeType(astType ast.Type) string {
+	switch node := astType.(type) {
+	case *ast.Named:
+		return node.Name.Value
+	case *ast.List:
+		return "[" + normalizeType(node.Type) + "]"
+	case *ast.NonNull:
+		return normalizeType(node.Type) + "!"
+	}
+
+	return ""
+}
+
+func normalizeSelectionSet(selectionSet *ast.SelectionSet) string {
+	if selectionSet == nil || len(selectionSet.Selections) == 0 {
+		return "{}"
+	}
+
+	selections := make([]string, 0, len(selectionSet.Selections))
+
+	for _, selection := range selectionSet.Selections {
+		switch node := selection.(type) {
+		case *ast.Field:
+			selections = append(selections, normalizeField(node))
+		case *ast.FragmentSpread:
+			selections = append(selections, "..."+node.Name.Value+normalizeDirectives(node.Directives))
+		case *ast.InlineFragment:
+			normalized := "..."
+			if node.TypeCondition != nil {
+				normalized += " on " + node.TypeCondition.Name.Value
+			}
+			normalized += normalizeDirectives(node.Directives) + " " + normalizeSelectionSet(node.SelectionSet)
+			selections = append(selections, normalized)
+		}
+	}
+
+	sort.Strings(selections)
+
+	return "{ " + strings.Join(selections, " ") + " }"
+}
+
+func normalizeField(field *ast.Field) string {
+	var builder strings.Builder
+
+	if field.Alias != nil {
+		builder.WriteString(field.Alias.Value + ": ")
+	}
+
+	builder.WriteString(field.Name.Value)
+	builder.WriteString(normalizeArguments(field.Arguments))
+	builder.WriteString(normalizeDirectives(field.Directives))
+
+	if field.SelectionSet != nil {
+		builder.WriteString(" " + normalizeSelectionSet(field.SelectionSet))
+	}
+
+	return builder.String()
+}
+
+func normalizeArguments(arguments []*ast.Argument) string {
+	if len(arguments) == 0 {
+		return ""
+	}
+
+	normalized := make([]string, 0, len(arguments))
+	for _, argument := range arguments {
+		normalized = append(normalized, argument.Name.Value+": "+normalizeValue(argument.Value))
+	}
+
+	sort.Strings(normalized)
+
+	return "(" + strings.Join(normalized, ", ") + ")"
+}
+
+func normalizeDirectives(directives []*ast.Directive) string {
+	if len(directives) == 0 {
+		return ""
+	}
+
+	normalized := make([]string, 0, len(directives))
+	for _, directive := range directives {
+		normalized = append(normalized, "@"+directive.Name.Value+normalizeArguments(directive.Arguments))
+	}
+
+	sort.Strings(normalized)
+
+	return " " + strings.Join(normalized, " ")
+}
+
+func normalizeValue(value ast.Value) string {
+	switch node := value.(type) {
+	case *ast.Variable:
+		return "$" + node.Name.Value
+	case *ast.StringValue:
+		return normalizedStringPlaceholder
+	case *ast.IntValue, *ast.FloatValue:
+		return normalizedNumberPlaceholder
+	case *ast.ListValue:
+		return normalizedListPlaceholder
+	case *ast.ObjectValue:
+		return normalizedObjectPlaceholder
+	case *ast.BooleanValue:
+		if node.Value {
+			return "true"
+		}
+		return "false"
+	case *ast.EnumValue:
+		return node.Value
+	}
+
+	return ""
+}
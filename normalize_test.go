@@ -0,0 +1,139 @@
+package traefikgraphqllimits
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+func normalizeTestQuery(t *testing.T, query string) string {
+	t.Helper()
+
+	astDoc, err := parser.Parse(parser.ParseParams{
+		Source:  query,
+		Options: parser.ParseOptions{NoLocation: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return normalizeQuery(astDoc)
+}
+
+func TestNormalizeQueryRedactsLiterals(t *testing.T) {
+	query := `
+    mutation Login($remember: Boolean = true, $tags: [String] = ["a"]) {
+      login(email: "john@example.com", password: "hunter2", attempts: 3, ratio: 0.5, ids: [1, 2], input: {token: "secret"}, mode: FAST, remember: $remember) {
+        token
+      }
+    }
+  `
+
+	normalized := normalizeTestQuery(t, query)
+
+	for _, secret := range []string{"john@example.com", "hunter2", "secret", "0.5", `"a"`} {
+		if strings.Contains(normalized, secret) {
+			t.Errorf("normalized query leaks %q: %s", secret, normalized)
+		}
+	}
+
+	expected := `mutation Login($remember: Boolean = true, $tags: [String] = []) ` +
+		`{ login(attempts: 0, email: "", ids: [], input: {}, mode: FAST, password: "", ratio: 0, remember: $remember) { token } }`
+	if normalized != expected {
+		t.Errorf("unexpected normalized query:\n got: %s\nwant: %s", normalized, expected)
+	}
+}
+
+func TestNormalizeQueryIsStable(t *testing.T) {
+	first := normalizeTestQuery(t, `
+    fragment userFields on User { name email }
+    query GetUser { user(id: "1", first: 10) { ...userFields friends @include(if: true) { id } } }
+  `)
+
+	second := normalizeTestQuery(t, `query GetUser{user(first:20,id:"2"){friends@include(if:true){id}...userFields}}
+fragment userFields on User{email name}`)
+
+	if first != second {
+		t.Errorf("equivalent queries normalized differently:\n%s\n%s", first, second)
+	}
+
+	expected := `fragment userFields on User { email name } ` +
+		`query GetUser { user(first: 0, id: "") { ...userFields friends @include(if: true) { id } } }`
+	if first != expected {
+		t.Errorf("unexpected normalized query:\n got: %s\nwant: %s", first, expected)
+	}
+}
+
+func TestGraphqlLogRejectedQueries(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := CreateConfig()
+	cfg.DepthLimit = 1
+	cfg.LogRejectedQueries = true
+
+	RunGraphqlLimitsTest(t, cfg, `query { user(email: "john@example.com") { friends { name } } }`, http.StatusBadRequest)
+	RunGraphqlLimitsTest(t, cfg, `query { user(email: "john@example.com" { name } }`, http.StatusBadRequest)
+
+	expected := `Rejected query with 400: query { user(email: "") { friends { name } } }`
+	if !strings.Contains(logs.String(), expected) || !strings.Contains(logs.String(), unparsableQueryPlaceholder) {
+		t.Errorf("expected the rejected queries to be logged redacted, got %q", logs.String())
+	}
+
+	if strings.Contains(logs.String(), "john@example.com") {
+		t.Errorf("expected literals to be redacted, got %q", logs.String())
+	}
+}
+
+func TestGraphqlLogRejectedQueriesNotParsed(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := CreateConfig()
+	cfg.MaxTokens = 5
+	cfg.LogRejectedQueries = true
+
+	RunGraphqlLimitsTest(t, cfg, `query { user(email: "john@example.com") { name } }`, http.StatusBadRequest)
+
+	cfg = CreateConfig()
+	cfg.MaxQueryLength = 10
+	cfg.LogRejectedQueries = true
+
+	RunGraphqlLimitsTest(t, cfg, `query { user(email: "john@example.com") { name } }`, http.StatusBadRequest)
+
+	if strings.Count(logs.String(), "Rejected query with 400: "+unparsedQueryPlaceholder) != 2 {
+		t.Errorf("expected the queries rejected before parsing to be logged as a placeholder, got %q", logs.String())
+	}
+}
+
+func TestGraphqlLogRejectedQueriesCached(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := CreateConfig()
+	cfg.DepthLimit = 1
+	cfg.QueryCacheSize = 10
+	cfg.LogRejectedQueries = true
+
+	handler, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), cfg, "traefik-graphql-limits-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		serveGraphqlTestRequest(t, handler, `{"query":"query { user(id: 1) { friends { name } } }"}`, nil)
+	}
+
+	if strings.Count(logs.String(), "Rejected query with 400: query { user(id: 0) { friends { name } } }") != 2 {
+		t.Errorf("expected the query to be logged from its cached analysis, got %q", logs.String())
+	}
+}
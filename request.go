@@ -0,0 +1,260 @@
+package traefikgraphqllimits
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"strings"
+
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+var (
+	errVariablesNotObject = errors.New("variables must be a JSON object")
+	errNotJSONObject      = errors.New("not a JSON object")
+	errAmbiguousRequest   = errors.New("duplicate request fields")
+)
+
+// graphqlRequest a GraphQL request sent either as the standard JSON envelope or as the raw query document.
+type graphqlRequest struct {
+	Query         string          `json:"query"`
+	OperationName string          `json:"operationName"`
+	Variables     json.RawMessage `json:"variables"`
+	// NOTE: A field is sent more than once, next may read another value than the one which is checked
+	ambiguous bool
+}
+
+// graphqlRequestFields the fields of the JSON envelope and the query string.
+var graphqlRequestFields = []string{"query", "operationName", "variables"}
+
+func parseGraphqlRequest(body []byte) graphqlRequest {
+	// NOTE: A raw anonymous query also starts with a brace, but it is never valid JSON
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		request, err := decodeGraphqlRequest(body)
+		if errors.Is(err, errAmbiguousRequest) {
+			return graphqlRequest{ambiguous: true}
+		}
+
+		if err == nil && request.Query != "" {
+			return request
+		}
+	}
+
+	return graphqlRequest{Query: string(body)}
+}
+
+// decodeGraphqlRequest decodes the JSON envelope of a request. Unlike json.Unmarshal, which matches fields
+// case-insensitively and keeps the last duplicate, a field sent twice or with another case is an ambiguous
+// request, as servers do not agree on which value they read.
+func decodeGraphqlRequest(data []byte) (graphqlRequest, error) {
+	var request graphqlRequest
+
+	fields, err := decodeGraphqlRequestFields(data)
+	if err != nil {
+		return request, err
+	}
+
+	if value, ok := fields["query"]; ok {
+		if err := json.Unmarshal(value, &request.Query); err != nil {
+			return request, err
+		}
+	}
+
+	if value, ok := fields["operationName"]; ok {
+		if err := json.Unmarshal(value, &request.OperationName); err != nil {
+			return request, err
+		}
+	}
+
+	request.Variables = fields["variables"]
+
+	return request, nil
+}
+
+// decodeGraphqlRequestFields returns the raw value of each of the graphqlRequestFields found in a JSON object.
+func decodeGraphqlRequestFields(data []byte) (map[string]json.RawMessage, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, errNotJSONObject
+	}
+
+	fields := make(map[string]json.RawMessage)
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		key, _ := token.(string)
+
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+
+		for _, field := range graphqlRequestFields {
+			if !strings.EqualFold(key, field) {
+				continue
+			}
+
+			if _, ok := fields[field]; ok || key != field {
+				return nil, errAmbiguousRequest
+			}
+
+			fields[field] = value
+		}
+	}
+
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return nil, errNotJSONObject
+	}
+
+	return fields, nil
+}
+
+// graphqlRequestFromQueryString reads a GraphQL request sent as the parameters of a GET request.
+func graphqlRequestFromQueryString(values url.Values) graphqlRequest {
+	for _, field := range graphqlRequestFields {
+		if len(values[field]) > 1 {
+			return graphqlRequest{ambiguous: true}
+		}
+	}
+
+	return graphqlRequest{
+		Query:         values.Get("query"),
+		OperationName: values.Get("operationName"),
+		Variables:     json.RawMessage(values.Get("variables")),
+	}
+}
+
+func (request graphqlRequest) hasVariables() bool {
+	return len(request.Variables) > 0 && !bytes.Equal(bytes.TrimSpace(request.Variables), []byte("null"))
+}
+
+func (request graphqlRequest) decodeVariables() (map[string]interface{}, error) {
+	variables := make(map[string]interface{})
+	if !request.hasVariables() {
+		return variables, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(request.Variables))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	variables, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errVariablesNotObject
+	}
+
+	return variables, nil
+}
+
+// intVariable converts the value of a variable used as a count, such as a list size, ok is false when it is not
+// provided. A value which is not a non-negative integer is unbounded.
+func intVariable(value interface{}) (int, bool) {
+	if value == nil {
+		return 0, false
+	}
+
+	number, ok := value.(json.Number)
+	if !ok {
+		return math.MaxInt32, true
+	}
+
+	count, err := number.Int64()
+	if err != nil || count < 0 || count > math.MaxInt32 {
+		return math.MaxInt32, true
+	}
+
+	return int(count), true
+}
+
+// variablesMetrics the variables metrics for check.
+type variablesMetrics struct {
+	size          int
+	maxDepth      int
+	maxListLength int
+}
+
+// calculateVariablesMetrics measures the variables of a request. The depth of a variable is the number of
+// nested input objects and lists in its value, so a scalar has a depth of 0.
+func calculateVariablesMetrics(request graphqlRequest) (variablesMetrics, error) {
+	metrics := variablesMetrics{size: len(request.Variables)}
+
+	variables, err := request.decodeVariables()
+	if err != nil {
+		return metrics, err
+	}
+
+	for _, value := range variables {
+		metrics.measure(value, 0)
+	}
+
+	return metrics, nil
+}
+
+func (metrics *variablesMetrics) measure(value interface{}, depth int) {
+	var children []interface{}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for _, field := range value {
+			children = append(children, field)
+		}
+	case []interface{}:
+		if len(value) > metrics.maxListLength {
+			metrics.maxListLength = len(value)
+		}
+		children = value
+	default:
+		return
+	}
+
+	depth++
+	if depth > metrics.maxDepth {
+		metrics.maxDepth = depth
+	}
+
+	for _, child := range children {
+		metrics.measure(child, depth)
+	}
+}
+
+// selectOperation returns the operation executed by the request, named by operationName unless the document
+// has a single operation. The error message is worded like the reference implementation.
+func (request graphqlRequest) selectOperation(astDoc *ast.Document) (*ast.OperationDefinition, string) {
+	operations := operationDefinitions(astDoc)
+
+	if request.OperationName == "" {
+		switch len(operations) {
+		case 0:
+			return nil, "Must provide an operation."
+		case 1:
+			return operations[0], ""
+		default:
+			return nil, "Must provide operation name if query contains multiple operations."
+		}
+	}
+
+	for _, operation := range operations {
+		if operation.Name != nil && operation.Name.Value == request.OperationName {
+			return operation, ""
+		}
+	}
+
+	return nil, fmt.Sprintf("Unknown operation named %q.", request.OperationName)
+}
@@ -0,0 +1,129 @@
+package traefikgraphqllimits
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseGraphqlRequest(t *testing.T) {
+	envelope := parseGraphqlRequest([]byte(`{"query": "query GetUser { user { name } }", "operationName": "GetUser", "variables": {"id": 1}}`))
+	if envelope.Query != "query GetUser { user { name } }" || envelope.OperationName != "GetUser" || string(envelope.Variables) != `{"id": 1}` {
+		t.Errorf("unexpected request: %+v", envelope)
+	}
+
+	raw := parseGraphqlRequest([]byte(`{ user { name } }`))
+	if raw.Query != `{ user { name } }` || raw.hasVariables() {
+		t.Errorf("unexpected request: %+v", raw)
+	}
+}
+
+func TestParseGraphqlRequestAmbiguous(t *testing.T) {
+	bodies := []string{
+		`{"query": "query { a { b { c } } }", "QUERY": "{ a }"}`,
+		`{"query": "query { a { b { c } } }", "query": "{ a }"}`,
+		`{"query": "{ a }", "operationName": "A", "OperationName": "B"}`,
+		`{"query": "{ a }", "variables": {}, "Variables": {"id": 1}}`,
+	}
+
+	for _, body := range bodies {
+		if request := parseGraphqlRequest([]byte(body)); !request.ambiguous {
+			t.Errorf("expected %s to be ambiguous, got %+v", body, request)
+		}
+	}
+
+	request := parseGraphqlRequest([]byte(`{"query": "{ a }", "extensions": {"query": 1}, "id": "1"}`))
+	if request.ambiguous || request.Query != "{ a }" {
+		t.Errorf("unexpected request: %+v", request)
+	}
+
+	query := url.Values{"query": {"query { a { b { c } } }", "{ a }"}}
+	if request := graphqlRequestFromQueryString(query); !request.ambiguous {
+		t.Errorf("expected repeated query parameters to be ambiguous, got %+v", request)
+	}
+}
+
+func TestGraphqlAmbiguousRequest(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DepthLimit = 2
+
+	RunGraphqlLimitsTest(t, cfg, `{"query": "query { a { b { c } } }", "QUERY": "{ a }"}`, http.StatusBadRequest)
+	RunGraphqlLimitsTest(t, cfg, `{"QUERY": "query { a { b { c } } }", "query": "{ a }"}`, http.StatusBadRequest)
+}
+
+func TestCalculateVariablesMetrics(t *testing.T) {
+	request := parseGraphqlRequest([]byte(`{
+    "query": "query { user { name } }",
+    "variables": {"id": 1, "empty": {}, "input": {"tags": ["a", "b", "c"], "address": {"geo": {"lat": 1}}}}
+  }`))
+
+	metrics, err := calculateVariablesMetrics(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metrics.size != len(request.Variables) || metrics.maxDepth != 3 || metrics.maxListLength != 3 {
+		t.Errorf("unexpected metrics: %+v", metrics)
+	}
+
+	_, err = calculateVariablesMetrics(parseGraphqlRequest([]byte(`{"query": "{ a }", "variables": [1]}`)))
+	if err == nil {
+		t.Error("expected an error for variables which are not an object")
+	}
+}
+
+func TestGraphqlMaxVariablesBytesReached(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxVariablesBytes = 32
+
+	body := `{"query": "query GetUsers($ids: [ID!]) { users(ids: $ids) { name } }", "variables": {"ids": [` +
+		strings.Repeat(`"1",`, 20) + `"1"]}}`
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusBadRequest)
+}
+
+func TestGraphqlMaxVariablesDepthReached(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxVariablesDepth = 2
+
+	body := `{"query": "mutation Save($input: Input) { save(input: $input) }", "variables": {"input": {"a": {"b": {"c": 1}}}}}`
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusBadRequest)
+}
+
+func TestGraphqlMaxVariablesDepthEqual(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxVariablesDepth = 3
+
+	body := `{"query": "mutation Save($input: Input) { save(input: $input) }", "variables": {"input": {"a": {"b": {"c": 1}}}}}`
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusOK)
+}
+
+func TestGraphqlMaxListLengthReachedInVariables(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxListLength = 2
+
+	body := `{"query": "query GetUsers($ids: [ID!]) { users(ids: $ids) { name } }", "variables": {"ids": [1, 2, 3]}}`
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusBadRequest)
+}
+
+func TestGraphqlMaxListLengthReachedInQuery(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxListLength = 2
+
+	body := `query { users(ids: [1, 2, 3]) { name } }`
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusBadRequest)
+}
+
+func TestGraphqlMaxListLengthNotReached(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxListLength = 3
+
+	body := `{"query": "query GetUsers($ids: [ID!]) { users(ids: $ids, roles: [ADMIN, USER]) { name } }", "variables": {"ids": [1, 2, 3]}}`
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusOK)
+}
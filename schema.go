@@ -0,0 +1,386 @@
+package traefikgraphqllimits
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/kinds"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+var builtinScalars = []string{"Int", "Float", "String", "Boolean", "ID"}
+
+// Directives from the GraphQL cost directive specification used to annotate the schema.
+const (
+	costDirective     = "cost"
+	listSizeDirective = "listSize"
+)
+
+// schemaField a field of an object or interface type declared in the schema.
+type schemaField struct {
+	typeName   string
+	isList     bool
+	arguments  map[string]*ast.InputValueDefinition
+	definition *ast.FieldDefinition
+	// NOTE: Values declared by the @cost and @listSize directives, only used when the matching has* flag is set
+	weight           int
+	hasWeight        bool
+	assumedSize      int
+	hasAssumedSize   bool
+	slicingArguments []string
+}
+
+// schemaType a named type declared in the schema, fields are only known for objects and interfaces.
+type schemaType struct {
+	kind      string
+	fields    map[string]*schemaField
+	weight    int
+	hasWeight bool
+}
+
+func (t *schemaType) isComposite() bool {
+	return t.kind == kinds.ObjectDefinition || t.kind == kinds.InterfaceDefinition || t.kind == kinds.UnionDefinition
+}
+
+// graphqlSchema the subset of a GraphQL schema needed to validate queries and estimate their cost.
+type graphqlSchema struct {
+	types     map[string]*schemaType
+	rootTypes map[string]string
+}
+
+func loadSchema(schemaFile string) (*graphqlSchema, error) {
+	sdl, err := os.ReadFile(schemaFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSchema(string(sdl))
+}
+
+func parseSchema(sdl string) (*graphqlSchema, error) {
+	astDoc, err := parser.Parse(parser.ParseParams{
+		Source: sdl,
+		Options: parser.ParseOptions{
+			NoLocation: true,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	schema := &graphqlSchema{
+		types: make(map[string]*schemaType),
+		rootTypes: map[string]string{
+			ast.OperationTypeQuery:        "Query",
+			ast.OperationTypeMutation:     "Mutation",
+			ast.OperationTypeSubscription: "Subscription",
+		},
+	}
+
+	for _, name := range builtinScalars {
+		schema.addType(name, kinds.ScalarDefinition)
+	}
+
+	for _, definition := range astDoc.Definitions {
+		if err := schema.addDefinition(definition); err != nil {
+			return nil, err
+		}
+	}
+
+	return schema, nil
+}
+
+func (schema *graphqlSchema) addDefinition(definition ast.Node) error {
+	switch node := definition.(type) {
+	case *ast.SchemaDefinition:
+		for _, operationType := range node.OperationTypes {
+			schema.rootTypes[operationType.Operation] = operationType.Type.Name.Value
+		}
+	case *ast.ObjectDefinition:
+		schema.addFields(node.Name.Value, node.Kind, node.Fields).setWeight(node.Directives)
+	case *ast.InterfaceDefinition:
+		schema.addFields(node.Name.Value, node.Kind, node.Fields).setWeight(node.Directives)
+	case *ast.TypeExtensionDefinition:
+		schema.addFields(node.Definition.Name.Value, node.Definition.Kind, node.Definition.Fields).setWeight(node.Definition.Directives)
+	case *ast.ScalarDefinition:
+		schema.addType(node.Name.Value, node.Kind).setWeight(node.Directives)
+	case *ast.UnionDefinition:
+		schema.addType(node.Name.Value, node.Kind).setWeight(node.Directives)
+	case *ast.EnumDefinition:
+		schema.addType(node.Name.Value, node.Kind).setWeight(node.Directives)
+	case *ast.InputObjectDefinition:
+		schema.addType(node.Name.Value, node.Kind)
+	case *ast.DirectiveDefinition:
+	default:
+		return fmt.Errorf("unexpected %s in schema", definition.GetKind())
+	}
+
+	return nil
+}
+
+func (schema *graphqlSchema) addType(name, kind string) *schemaType {
+	namedType, ok := schema.types[name]
+	if !ok {
+		namedType = &schemaType{kind: kind, fields: make(map[string]*schemaField)}
+		schema.types[name] = namedType
+	}
+
+	return namedType
+}
+
+func (schema *graphqlSchema) addFields(typeName, kind string, fields []*ast.FieldDefinition) *schemaType {
+	namedType := schema.addType(typeName, kind)
+
+	for _, field := range fields {
+		fieldTypeName, isList := unwrapType(field.Type)
+
+		arguments := make(map[string]*ast.InputValueDefinition, len(field.Arguments))
+		for _, argument := range field.Arguments {
+			arguments[argument.Name.Value] = argument
+		}
+
+		namedField := &schemaField{
+			typeName:   fieldTypeName,
+			isList:     isList,
+			arguments:  arguments,
+			definition: field,
+		}
+		namedField.weight, namedField.hasWeight = costWeight(field.Directives)
+		namedField.setListSize(field.Directives)
+
+		namedType.fields[field.Name.Value] = namedField
+	}
+
+	return namedType
+}
+
+func (t *schemaType) setWeight(directives []*ast.Directive) {
+	if weight, ok := costWeight(directives); ok {
+		t.weight, t.hasWeight = weight, true
+	}
+}
+
+// costWeight reads the weight declared by a @cost(weight: ...) directive.
+func costWeight(directives []*ast.Directive) (int, bool) {
+	directive := findDirective(directives, costDirective)
+	if directive == nil {
+		return 0, false
+	}
+
+	return intArgument(directive.Arguments, "weight")
+}
+
+// setListSize reads a @listSize(assumedSize: ..., slicingArguments: [...]) directive.
+func (f *schemaField) setListSize(directives []*ast.Directive) {
+	directive := findDirective(directives, listSizeDirective)
+	if directive == nil {
+		return
+	}
+
+	f.assumedSize, f.hasAssumedSize = intArgument(directive.Arguments, "assumedSize")
+
+	for _, argument := range directive.Arguments {
+		if argument.Name.Value != "slicingArguments" {
+			continue
+		}
+
+		if list, ok := argument.Value.(*ast.ListValue); ok {
+			for _, value := range list.Values {
+				if name, ok := value.(*ast.StringValue); ok {
+					f.slicingArguments = append(f.slicingArguments, name.Value)
+				}
+			}
+		}
+	}
+}
+
+func findDirective(directives []*ast.Directive, name string) *ast.Directive {
+	for _, directive := range directives {
+		if directive.Name.Value == name {
+			return directive
+		}
+	}
+
+	return nil
+}
+
+// intArgument reads a non-negative integer argument, accepting the string form used by the cost directive
+// specification as well as a plain Int.
+func intArgument(arguments []*ast.Argument, name string) (int, bool) {
+	for _, argument := range arguments {
+		if argument.Name.Value != name {
+			continue
+		}
+
+		var literal string
+		switch value := argument.Value.(type) {
+		case *ast.IntValue:
+			literal = value.Value
+		case *ast.StringValue:
+			literal = value.Value
+		default:
+			return 0, false
+		}
+
+		number, err := strconv.Atoi(literal)
+		if err != nil || number < 0 {
+			return 0, false
+		}
+
+		return number, true
+	}
+
+	return 0, false
+}
+
+// field looks up a field on a type, returning nil when it is unknown or the schema is not configured.
+func (schema *graphqlSchema) field(typeName, fieldName string) *schemaField {
+	if schema == nil {
+		return nil
+	}
+
+	namedType, ok := schema.types[typeName]
+	if !ok {
+		return nil
+	}
+
+	return namedType.fields[fieldName]
+}
+
+func (schema *graphqlSchema) isComposite(typeName string) bool {
+	namedType, ok := schema.types[typeName]
+
+	return ok && namedType.isComposite()
+}
+
+// unwrapType returns the named type wrapped by list and non-null types, and whether it is a list.
+func unwrapType(astType ast.Type) (string, bool) {
+	switch node := astType.(type) {
+	case *ast.NonNull:
+		return unwrapType(node.Type)
+	case *ast.List:
+		name, _ := unwrapType(node.Type)
+		return name, true
+	case *ast.Named:
+		return node.Name.Value, false
+	}
+
+	return "", false
+}
+
+// validate checks that the document only references types, fields, arguments and fragments known to the
+// schema, returning the error messages worded like the reference implementation.
+func (schema *graphqlSchema) validate(astDoc *ast.Document) []string {
+	var errorMessages []string
+
+	fragments := fragmentDefinitions(astDoc)
+
+	for _, definition := range astDoc.Definitions {
+		switch node := definition.(type) {
+		case *ast.OperationDefinition:
+			rootType := schema.rootTypes[node.Operation]
+			if _, ok := schema.types[rootType]; !ok {
+				errorMessages = append(errorMessages, fmt.Sprintf("Schema is not configured for %ss.", node.Operation))
+				continue
+			}
+
+			for _, variable := range node.VariableDefinitions {
+				typeName, _ := unwrapType(variable.Type)
+				if _, ok := schema.types[typeName]; !ok {
+					errorMessages = append(errorMessages, fmt.Sprintf("Unknown type %q.", typeName))
+				}
+			}
+
+			errorMessages = schema.validateSelectionSet(errorMessages, node.SelectionSet, rootType, fragments)
+		case *ast.FragmentDefinition:
+			typeName := node.TypeCondition.Name.Value
+			if _, ok := schema.types[typeName]; !ok {
+				errorMessages = append(errorMessages, fmt.Sprintf("Unknown type %q.", typeName))
+				continue
+			}
+
+			errorMessages = schema.validateSelectionSet(errorMessages, node.SelectionSet, typeName, fragments)
+		}
+	}
+
+	return errorMessages
+}
+
+func (schema *graphqlSchema) validateSelectionSet(
+	errorMessages []string,
+	selectionSet *ast.SelectionSet,
+	typeName string,
+	fragments map[string]*ast.FragmentDefinition,
+) []string {
+	if selectionSet == nil {
+		return errorMessages
+	}
+
+	for _, selection := range selectionSet.Selections {
+		switch node := selection.(type) {
+		case *ast.Field:
+			errorMessages = schema.validateField(errorMessages, node, typeName, fragments)
+		case *ast.InlineFragment:
+			fragmentTypeName := typeName
+			if node.TypeCondition != nil {
+				fragmentTypeName = node.TypeCondition.Name.Value
+				if _, ok := schema.types[fragmentTypeName]; !ok {
+					errorMessages = append(errorMessages, fmt.Sprintf("Unknown type %q.", fragmentTypeName))
+					continue
+				}
+			}
+
+			errorMessages = schema.validateSelectionSet(errorMessages, node.SelectionSet, fragmentTypeName, fragments)
+		case *ast.FragmentSpread:
+			if _, ok := fragments[node.Name.Value]; !ok {
+				errorMessages = append(errorMessages, fmt.Sprintf("Unknown fragment %q.", node.Name.Value))
+			}
+		}
+	}
+
+	return errorMessages
+}
+
+func (schema *graphqlSchema) validateField(
+	errorMessages []string,
+	field *ast.Field,
+	typeName string,
+	fragments map[string]*ast.FragmentDefinition,
+) []string {
+	fieldName := field.Name.Value
+
+	// NOTE: Introspection fields are provided by every GraphQL server and are not part of the SDL
+	if strings.HasPrefix(fieldName, "__") {
+		return errorMessages
+	}
+
+	definition := schema.field(typeName, fieldName)
+	if definition == nil {
+		return append(errorMessages, fmt.Sprintf("Cannot query field %q on type %q.", fieldName, typeName))
+	}
+
+	for _, argument := range field.Arguments {
+		if _, ok := definition.arguments[argument.Name.Value]; !ok {
+			errorMessages = append(errorMessages,
+				fmt.Sprintf("Unknown argument %q on field %q.", argument.Name.Value, typeName+"."+fieldName))
+		}
+	}
+
+	isComposite := schema.isComposite(definition.typeName)
+
+	switch {
+	case isComposite && field.SelectionSet == nil:
+		errorMessages = append(errorMessages, fmt.Sprintf("Field %q of type %q must have a selection of subfields.",
+			fieldName, definition.typeName))
+	case !isComposite && field.SelectionSet != nil:
+		errorMessages = append(errorMessages, fmt.Sprintf("Field %q must not have a selection since type %q has no subfields.",
+			fieldName, definition.typeName))
+	default:
+		errorMessages = schema.validateSelectionSet(errorMessages, field.SelectionSet, definition.typeName, fragments)
+	}
+
+	return errorMessages
+}
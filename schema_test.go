@@ -0,0 +1,215 @@
+package traefikgraphqllimits
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+const testSchema = `
+  schema {
+    query: Query
+    mutation: Mutation
+  }
+
+  type Query {
+    user(id: ID!): User
+    users(first: Int, after: String): [User!]!
+    search(term: String!): [SearchResult]
+  }
+
+  type Mutation {
+    deleteUser(id: ID!): Boolean
+  }
+
+  interface Node {
+    id: ID!
+  }
+
+  type User implements Node {
+    id: ID!
+    name: String
+    email: String
+    friends(first: Int): [User]
+    posts(last: Int): [Post]
+  }
+
+  type Post implements Node {
+    id: ID!
+    title: String
+  }
+
+  union SearchResult = User | Post
+
+  extend type Query {
+    node(id: ID!): Node
+  }
+`
+
+func writeTestSchema(t *testing.T, sdl string) string {
+	t.Helper()
+
+	schemaFile := filepath.Join(t.TempDir(), "schema.graphql")
+
+	err := os.WriteFile(schemaFile, []byte(sdl), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return schemaFile
+}
+
+func validateTestQuery(t *testing.T, sdl, query string) []string {
+	t.Helper()
+
+	schema, err := parseSchema(sdl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	astDoc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return schema.validate(astDoc)
+}
+
+func TestSchemaValidateKnownDocument(t *testing.T) {
+	query := `
+    query GetUser($id: ID!) {
+      user(id: $id) {
+        __typename
+        ...userFields
+        friends(first: 5) {
+          ... on User { name }
+        }
+      }
+      search(term: "john") {
+        ... on Post { title }
+      }
+      node(id: $id) { id }
+      __schema { types { name } }
+    }
+
+    fragment userFields on User {
+      id
+      email
+    }
+  `
+
+	errorMessages := validateTestQuery(t, testSchema, query)
+	if len(errorMessages) > 0 {
+		t.Errorf("unexpected validation errors: %v", errorMessages)
+	}
+}
+
+func TestSchemaValidateUnknownReferences(t *testing.T) {
+	query := `
+    query GetUser($id: ID!, $filter: UserFilter) {
+      user(id: $id, filter: $filter) {
+        nmae
+        friends {
+          ... on Comment { text }
+        }
+        ...missingFields
+      }
+      users
+    }
+
+    fragment postFields on Post {
+      title { text }
+    }
+
+    subscription OnUser {
+      userCreated { id }
+    }
+  `
+
+	expected := []string{
+		`Unknown type "UserFilter".`,
+		`Unknown argument "filter" on field "Query.user".`,
+		`Cannot query field "nmae" on type "User".`,
+		`Unknown type "Comment".`,
+		`Unknown fragment "missingFields".`,
+		`Field "users" of type "User" must have a selection of subfields.`,
+		`Field "title" must not have a selection since type "String" has no subfields.`,
+		`Schema is not configured for subscriptions.`,
+	}
+
+	errorMessages := validateTestQuery(t, testSchema, query)
+	if !reflect.DeepEqual(errorMessages, expected) {
+		t.Errorf("unexpected validation errors:\n got: %q\nwant: %q", errorMessages, expected)
+	}
+}
+
+func TestGraphqlLimitInvalidSchemaFile(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SchemaFile = writeTestSchema(t, "type Query {")
+
+	_, err := New(context.Background(), http.NotFoundHandler(), cfg, "traefik-graphql-limits-plugin")
+	if err == nil {
+		t.Error("expected an error for an invalid schema file")
+	}
+}
+
+func TestGraphqlSchemaValidationFailed(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SchemaFile = writeTestSchema(t, testSchema)
+
+	body := `
+    query GetUser($id: ID!) {
+      user(id: $id) {
+        password
+      }
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusBadRequest)
+}
+
+func TestGraphqlSchemaValidationPassed(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SchemaFile = writeTestSchema(t, testSchema)
+
+	body := `
+    query GetUser($id: ID!) {
+      user(id: $id) {
+        name
+        email
+      }
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusOK)
+}
+
+func TestGraphqlFragmentCycle(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.CostLimit = 100
+
+	body := `
+    query GetUser {
+      user(id: 1) {
+        ...userFields
+      }
+    }
+
+    fragment userFields on User {
+      friends {
+        ...friendFields
+      }
+    }
+
+    fragment friendFields on User {
+      ...userFields
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusBadRequest)
+}
@@ -0,0 +1,260 @@
+package traefikgraphqllimits
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// executedOperations returns the operation selected by the request, or every operation of the document when
+// none can be selected, so that limits are then checked against the largest one.
+func executedOperations(astDoc *ast.Document, request graphqlRequest) []*ast.OperationDefinition {
+	if operation, errorMessage := request.selectOperation(astDoc); errorMessage == "" {
+		return []*ast.OperationDefinition{operation}
+	}
+
+	return operationDefinitions(astDoc)
+}
+
+func responseKey(field *ast.Field) string {
+	if field.Alias != nil {
+		return field.Alias.Value
+	}
+
+	return field.Name.Value
+}
+
+// calculateRootFieldCount counts the distinct root fields, by response key, selected by the executed operation
+// once fragments are expanded. The document must not contain fragment cycles.
+func calculateRootFieldCount(astDoc *ast.Document, request graphqlRequest) int {
+	fragments := fragmentDefinitions(astDoc)
+	maxRootFieldCount := 0
+
+	for _, operation := range executedOperations(astDoc, request) {
+		responseKeys := make(map[string]bool)
+		for _, collected := range collectFields(operation.SelectionSet, fragments) {
+			responseKeys[responseKey(collected.field)] = true
+		}
+
+		if len(responseKeys) > maxRootFieldCount {
+			maxRootFieldCount = len(responseKeys)
+		}
+	}
+
+	return maxRootFieldCount
+}
+
+// rootFieldDepthCalculator measures the depth below each root field once fragments are expanded.
+type rootFieldDepthCalculator struct {
+	options   queryMetricsOptions
+	expansion *expansionCache
+}
+
+// calculateRootFieldDepths returns the depth of each root field of the executed operation by `Type.field`
+// coordinate, root fields selected through fragments included. A root field selecting only scalars has a depth
+// of 1, like in calculateQueryMetrics. The document must not contain fragment cycles.
+func calculateRootFieldDepths(astDoc *ast.Document, request graphqlRequest, options queryMetricsOptions) map[string]int {
+	calculator := &rootFieldDepthCalculator{
+		options:   options,
+		expansion: newExpansionCache(fragmentDefinitions(astDoc)),
+	}
+
+	rootFieldDepths := make(map[string]int)
+
+	for _, operation := range executedOperations(astDoc, request) {
+		rootType := rootTypeName(options.schema, operation.Operation)
+
+		for _, collected := range calculator.fields(operation.SelectionSet) {
+			if collected.field.SelectionSet == nil {
+				continue
+			}
+
+			coordinate := rootType + "." + collected.field.Name.Value
+			if depth := calculator.depth(collected.field.SelectionSet); depth > rootFieldDepths[coordinate] {
+				rootFieldDepths[coordinate] = depth
+			}
+		}
+	}
+
+	return rootFieldDepths
+}
+
+// fields returns the fields selected by a selection set, without the ignored introspection fields.
+func (calculator *rootFieldDepthCalculator) fields(selectionSet *ast.SelectionSet) []collectedField {
+	collected := calculator.expansion.collectFields(selectionSet)
+	if !calculator.options.ignoreIntrospection {
+		return collected
+	}
+
+	fields := collected[:0:0]
+	for _, field := range collected {
+		if !isIntrospectionField(field.field) {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+// depth returns the number of nested selection sets from the given one, which counts as one.
+func (calculator *rootFieldDepthCalculator) depth(selectionSet *ast.SelectionSet) int {
+	if depth, ok := calculator.expansion.lookup(selectionSet); ok {
+		return depth.(int)
+	}
+
+	fields := calculator.fields(selectionSet)
+
+	depth := 1
+	if calculator.options.ignoreTypename && selectsOnlyTypenameFields(fields) {
+		depth = 0
+	}
+
+	for _, collected := range fields {
+		if collected.field.SelectionSet == nil {
+			continue
+		}
+
+		if fieldDepth := 1 + calculator.depth(collected.field.SelectionSet); fieldDepth > depth {
+			depth = fieldDepth
+		}
+	}
+
+	calculator.expansion.store(selectionSet, depth)
+
+	return depth
+}
+
+func selectsOnlyTypenameFields(fields []collectedField) bool {
+	for _, collected := range fields {
+		if collected.field.Name.Value != "__typename" {
+			return false
+		}
+	}
+
+	return len(fields) > 0
+}
+
+// breadthCalculator finds the selection set with the most fields once fragments are expanded.
+type breadthCalculator struct {
+	mergeDuplicates bool
+	// NOTE: Keyed by selectionSetsKey, merged fields are measured together
+	expansion *expansionCache
+}
+
+// breadthResult the widest selection set below a visited one, with the response keys leading to it from there.
+type breadthResult struct {
+	breadth  int
+	path     []string
+	location *ast.Location
+}
+
+// calculateMaxBreadth returns the number of fields of the widest selection set of the executed operation and
+// the response keys leading to it, with its location when the document was parsed with locations. When
+// mergeDuplicates is set, fields with the same response key are merged like the executor does, so they are
+// counted once and their selections are combined. The document must not contain fragment cycles.
+func calculateMaxBreadth(astDoc *ast.Document, request graphqlRequest, mergeDuplicates bool) (int, []string, *ast.Location) {
+	calculator := &breadthCalculator{
+		mergeDuplicates: mergeDuplicates,
+		expansion:       newExpansionCache(fragmentDefinitions(astDoc)),
+	}
+
+	var widest breadthResult
+
+	for _, operation := range executedOperations(astDoc, request) {
+		if result := calculator.visit([]*ast.SelectionSet{operation.SelectionSet}); result.breadth > widest.breadth {
+			widest = result
+		}
+	}
+
+	return widest.breadth, widest.path, widest.location
+}
+
+// visit measures the selection set formed by the given selection sets, which are several when merging fields,
+// and the selection sets below it.
+func (calculator *breadthCalculator) visit(selectionSets []*ast.SelectionSet) breadthResult {
+	resultKey := selectionSetsKey(selectionSets)
+	if result, ok := calculator.expansion.lookup(resultKey); ok {
+		return result.(breadthResult)
+	}
+
+	var responseKeys []string
+	fieldsByResponseKey := make(map[string][]*ast.Field)
+	breadth := 0
+
+	for _, selectionSet := range selectionSets {
+		for _, collected := range calculator.expansion.collectFields(selectionSet) {
+			key := responseKey(collected.field)
+			if _, ok := fieldsByResponseKey[key]; !ok {
+				responseKeys = append(responseKeys, key)
+			}
+			fieldsByResponseKey[key] = append(fieldsByResponseKey[key], collected.field)
+			breadth++
+		}
+	}
+
+	if calculator.mergeDuplicates {
+		breadth = len(responseKeys)
+	}
+
+	widest := breadthResult{breadth: breadth, location: selectionSets[0].Loc}
+
+	for _, key := range responseKeys {
+		for _, fieldSelectionSets := range calculator.fieldSelectionSets(fieldsByResponseKey[key]) {
+			if result := calculator.visit(fieldSelectionSets); result.breadth > widest.breadth {
+				widest = breadthResult{
+					breadth:  result.breadth,
+					path:     append([]string{key}, result.path...),
+					location: result.location,
+				}
+			}
+		}
+	}
+
+	calculator.expansion.store(resultKey, widest)
+
+	return widest
+}
+
+// fieldSelectionSets groups the selection sets of the fields with the same response key as they are measured,
+// merged into one when merging duplicates.
+func (calculator *breadthCalculator) fieldSelectionSets(fields []*ast.Field) [][]*ast.SelectionSet {
+	var groups [][]*ast.SelectionSet
+
+	for _, field := range fields {
+		if field.SelectionSet == nil {
+			continue
+		}
+
+		// NOTE: A fragment spread under several merged fields selects the same field more than once
+		if calculator.mergeDuplicates && len(groups) > 0 {
+			if !containsSelectionSet(groups[0], field.SelectionSet) {
+				groups[0] = append(groups[0], field.SelectionSet)
+			}
+			continue
+		}
+
+		groups = append(groups, []*ast.SelectionSet{field.SelectionSet})
+	}
+
+	return groups
+}
+
+func containsSelectionSet(selectionSets []*ast.SelectionSet, selectionSet *ast.SelectionSet) bool {
+	for _, candidate := range selectionSets {
+		if candidate == selectionSet {
+			return true
+		}
+	}
+
+	return false
+}
+
+func selectionSetsKey(selectionSets []*ast.SelectionSet) string {
+	pointers := make([]string, 0, len(selectionSets))
+	for _, selectionSet := range selectionSets {
+		pointers = append(pointers, fmt.Sprintf("%p", selectionSet))
+	}
+
+	return strings.Join(pointers, ",")
+}
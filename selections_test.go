@@ -0,0 +1,231 @@
+package traefikgraphqllimits
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+func TestCalculateRootFieldCount(t *testing.T) {
+	body := `{
+    "query": "query A { a b ...rootFields ... on Query { d e } a } query B { a } fragment rootFields on Query { c alias: a }",
+    "operationName": "A"
+  }`
+
+	request := parseGraphqlRequest([]byte(body))
+
+	astDoc, err := parser.Parse(parser.ParseParams{Source: request.Query})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootFieldCount := calculateRootFieldCount(astDoc, request)
+	if rootFieldCount != 6 {
+		t.Errorf("unexpected root field count: %d", rootFieldCount)
+	}
+
+	request.OperationName = "B"
+
+	rootFieldCount = calculateRootFieldCount(astDoc, request)
+	if rootFieldCount != 1 {
+		t.Errorf("unexpected root field count: %d", rootFieldCount)
+	}
+}
+
+func TestCalculateRootFieldDepths(t *testing.T) {
+	query := `
+    query Home {
+      viewer { name }
+      ... on Query { search { a { b { c } } } }
+      ...feed
+    }
+
+    fragment feed on Query {
+      feed { posts { title } }
+    }
+  `
+
+	astDoc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootFieldDepths := calculateRootFieldDepths(astDoc, graphqlRequest{}, queryMetricsOptions{})
+
+	expected := map[string]int{"Query.viewer": 1, "Query.search": 3, "Query.feed": 2}
+	if !reflect.DeepEqual(rootFieldDepths, expected) {
+		t.Errorf("unexpected root field depths: %v", rootFieldDepths)
+	}
+
+	astDoc, err = parser.Parse(parser.ParseParams{Source: chainedFragmentsQuery(40)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootFieldDepths = calculateRootFieldDepths(astDoc, graphqlRequest{}, queryMetricsOptions{})
+	if rootFieldDepths["Query.a"] != 40 {
+		t.Errorf("unexpected root field depths: %v", rootFieldDepths)
+	}
+}
+
+func TestGraphqlRootFieldDepthLimitsFragments(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.RootFieldDepthLimits = map[string]int{"Query.viewer": 1, "Query.search": 1}
+
+	RunGraphqlLimitsTest(t, cfg, `query { viewer { name } ... on Query { search { a { b } } } }`, http.StatusBadRequest)
+	RunGraphqlLimitsTest(t, cfg, `query { ...Q } fragment Q on Query { search { a { b } } }`, http.StatusBadRequest)
+	RunGraphqlLimitsTest(t, cfg, `query { viewer { name } ... on Query { search { title } } }`, http.StatusOK)
+}
+
+func TestGraphqlRootFieldLimitReached(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.RootFieldLimit = 3
+
+	body := `
+    query Dashboard {
+      viewer { name }
+      ...counters
+    }
+
+    fragment counters on Query {
+      users { count }
+      posts { count }
+      comments { count }
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusBadRequest)
+}
+
+func TestGraphqlRootFieldLimitEqual(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.RootFieldLimit = 4
+
+	body := `
+    query Dashboard {
+      viewer { name }
+      ...counters
+    }
+
+    fragment counters on Query {
+      users { count }
+      posts { count }
+      comments { count }
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusOK)
+}
+
+func TestCalculateMaxBreadth(t *testing.T) {
+	query := `
+    query Feed {
+      viewer {
+        name
+        feed {
+          id
+          title
+          ...postFields
+          ... on Post { id }
+        }
+        feed {
+          author
+        }
+      }
+    }
+
+    fragment postFields on Post {
+      body
+      title
+    }
+  `
+
+	astDoc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	breadth, path, _ := calculateMaxBreadth(astDoc, graphqlRequest{}, false)
+	if breadth != 5 || len(path) != 2 || path[0] != "viewer" || path[1] != "feed" {
+		t.Errorf("unexpected breadth: %d at %v", breadth, path)
+	}
+
+	breadth, path, _ = calculateMaxBreadth(astDoc, graphqlRequest{}, true)
+	if breadth != 4 || len(path) != 2 || path[0] != "viewer" || path[1] != "feed" {
+		t.Errorf("unexpected merged breadth: %d at %v", breadth, path)
+	}
+}
+
+func TestCalculateMaxBreadthChainedFragments(t *testing.T) {
+	astDoc, err := parser.Parse(parser.ParseParams{Source: chainedFragmentsQuery(40)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mergeDuplicates := range []bool{false, true} {
+		if breadth, _, _ := calculateMaxBreadth(astDoc, graphqlRequest{}, mergeDuplicates); breadth != 2 {
+			t.Errorf("unexpected breadth: %d", breadth)
+		}
+	}
+
+	// NOTE: Merged fields spreading the same fragment
+	query := strings.ReplaceAll(chainedFragmentsQuery(40), " b { ", " a { ")
+
+	astDoc, err = parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if breadth, _, _ := calculateMaxBreadth(astDoc, graphqlRequest{}, true); breadth != 2 {
+		t.Errorf("unexpected breadth: %d", breadth)
+	}
+}
+
+func TestGraphqlBreadthLimitReached(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BreadthLimit = 3
+
+	body := `
+    query GetUser {
+      user(id: 1) {
+        name
+        email
+        ...contact
+      }
+    }
+
+    fragment contact on User {
+      phone
+      address
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusBadRequest)
+}
+
+func TestGraphqlBreadthLimitMergeDuplicates(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BreadthLimit = 3
+	cfg.BreadthMergeDuplicates = true
+
+	body := `
+    query GetUser {
+      user(id: 1) {
+        name
+        email
+        ...contact
+      }
+    }
+
+    fragment contact on User {
+      name
+      email
+      phone
+    }
+  `
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusOK)
+}
@@ -0,0 +1,102 @@
+package traefikgraphqllimits
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Media types of the streamed responses of GraphQL over Server-Sent Events and of incremental delivery.
+const (
+	eventStreamMediaType    = "text/event-stream"
+	multipartMixedMediaType = "multipart/mixed"
+	jsonMediaType           = "application/json"
+)
+
+// responseMediaType returns the first media type of the Accept header the errors can be sent as, JSON being
+// the default.
+func responseMediaType(req *http.Request) string {
+	for _, value := range req.Header.Values("Accept") {
+		for _, part := range strings.Split(value, ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+
+			switch mediaType {
+			case eventStreamMediaType, multipartMixedMediaType, jsonMediaType:
+				return mediaType
+			}
+		}
+	}
+
+	return jsonMediaType
+}
+
+// respondWithError sends the errors of a rejected request in the format the client negotiated. Streamed
+// formats are answered with a 200 status since the errors are part of the stream.
+func respondWithError(rw http.ResponseWriter, req *http.Request, statusCode int, json string) {
+	switch responseMediaType(req) {
+	case eventStreamMediaType:
+		respondWithEventStreamError(rw, json)
+	case multipartMixedMediaType:
+		respondWithMultipartError(rw, json)
+	default:
+		respondWithJSONError(rw, statusCode, json)
+	}
+}
+
+// respondWithEventStreamError sends the errors as a `next` event followed by a `complete` event.
+func respondWithEventStreamError(rw http.ResponseWriter, json string) {
+	rw.Header().Set("Content-Type", eventStreamMediaType)
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+
+	_, err := fmt.Fprintf(rw, "event: next\ndata: %s\n\nevent: complete\ndata:\n\n", compactJSON(json))
+	if err != nil {
+		log.Printf("Error with response: %v", err)
+	}
+}
+
+// respondWithMultipartError sends the errors as the single and last part of an incremental delivery response.
+func respondWithMultipartError(rw http.ResponseWriter, json string) {
+	rw.Header().Set("Content-Type", multipartMixedMediaType+`; boundary="-"`)
+	rw.WriteHeader(http.StatusOK)
+
+	_, err := fmt.Fprintf(rw, "\r\n---\r\nContent-Type: application/json; charset=utf-8\r\n\r\n%s\r\n-----\r\n",
+		finalPayload(json))
+	if err != nil {
+		log.Printf("Error with response: %v", err)
+	}
+}
+
+// finalPayload marks an error response as the last payload of an incremental delivery.
+func finalPayload(body string) []byte {
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		return compactJSON(body)
+	}
+
+	payload["hasNext"] = json.RawMessage("false")
+
+	encodedPayload, err := json.Marshal(payload)
+	if err != nil {
+		return compactJSON(body)
+	}
+
+	return encodedPayload
+}
+
+// compactJSON removes the newlines of an error body, which would end an event stream data field.
+func compactJSON(body string) []byte {
+	var buffer bytes.Buffer
+	if err := json.Compact(&buffer, []byte(body)); err != nil {
+		return []byte(strings.ReplaceAll(body, "\n", " "))
+	}
+
+	return buffer.Bytes()
+}
@@ -0,0 +1,97 @@
+package traefikgraphqllimits
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func runStreamingTest(t *testing.T, req *http.Request, expectedContentType string, expectedParts ...string) {
+	t.Helper()
+
+	cfg := CreateConfig()
+	cfg.DepthLimit = 2
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if _, ok := rw.(http.Flusher); !ok {
+			t.Error("expected next to be able to flush the streamed response")
+		}
+	})
+
+	handler, err := New(context.Background(), next, cfg, "traefik-graphql-limits-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("invalid code: %d", resp.StatusCode)
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, expectedContentType) {
+		t.Errorf("expected content type %q, got %q", expectedContentType, contentType)
+	}
+
+	for _, expectedPart := range expectedParts {
+		if !strings.Contains(string(body), expectedPart) {
+			t.Errorf("expected body to contain %q, got %q", expectedPart, body)
+		}
+	}
+}
+
+func TestEventStreamError(t *testing.T) {
+	req := newGraphqlTestRequest(t, http.MethodPost, "http://localhost/graphql", deepQuery, http.Header{"Accept": {"text/event-stream"}})
+
+	runStreamingTest(t, req, eventStreamMediaType,
+		"event: next\ndata: {\"errors\":[{\"code\":400,", "}]}\n\nevent: complete\ndata:\n\n")
+}
+
+func TestEventStreamGetError(t *testing.T) {
+	target := "http://localhost/graphql?query=" + url.QueryEscape(deepSelection)
+	req := newGraphqlTestRequest(t, http.MethodGet, target, "", http.Header{"Accept": {"text/event-stream"}})
+
+	runStreamingTest(t, req, eventStreamMediaType, "event: next\n")
+}
+
+func TestMultipartError(t *testing.T) {
+	req := newGraphqlTestRequest(t, http.MethodPost, "http://localhost/graphql", deepQuery,
+		http.Header{"Accept": {"multipart/mixed;deferSpec=20220824, application/json"}})
+
+	runStreamingTest(t, req, multipartMixedMediaType,
+		"\r\n---\r\nContent-Type: application/json; charset=utf-8\r\n\r\n{\"errors\":[{\"code\":400,",
+		"}],\"hasNext\":false}\r\n-----\r\n")
+}
+
+func TestStreamingRequestAllowed(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DepthLimit = 2
+
+	flushed := false
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", eventStreamMediaType)
+		_, _ = io.WriteString(rw, "event: next\ndata: {}\n\n")
+		rw.(http.Flusher).Flush()
+		flushed = true
+	})
+
+	handler, err := New(context.Background(), next, cfg, "traefik-graphql-limits-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := serveGraphqlTestRequest(t, handler, `{"query":"query { user { name } }"}`,
+		http.Header{"Accept": {"text/event-stream"}})
+
+	if !flushed || !recorder.Flushed {
+		t.Error("expected the streamed response to be flushed by next")
+	}
+}
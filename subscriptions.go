@@ -0,0 +1,71 @@
+package traefikgraphqllimits
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// subscriptionLimits caps the operations active at the same time over WebSocket, per connection and per client.
+// Clients are identified by the value of clientHeader, or by their remote address without it.
+type subscriptionLimits struct {
+	perConnection int
+	perClient     int
+	clientHeader  string
+	closeCode     int
+
+	mu      sync.Mutex
+	clients map[string]int
+}
+
+func (s *subscriptionLimits) isEnabled() bool {
+	return s.perConnection > 0 || s.perClient > 0
+}
+
+func (s *subscriptionLimits) clientID(req *http.Request) string {
+	if s.clientHeader != "" {
+		if value := req.Header.Get(s.clientHeader); value != "" {
+			return value
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// acquire counts a new active operation of the client, returning false without counting it when the client
+// already holds perClient operations.
+func (s *subscriptionLimits) acquire(client string) bool {
+	if s.perClient <= 0 {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.clients[client] >= s.perClient {
+		return false
+	}
+
+	s.clients[client]++
+
+	return true
+}
+
+func (s *subscriptionLimits) release(client string, count int) {
+	if s.perClient <= 0 || count == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clients[client] -= count
+	if s.clients[client] <= 0 {
+		delete(s.clients, client)
+	}
+}
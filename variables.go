@@ -0,0 +1,195 @@
+package traefikgraphqllimits
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// operationVariables what the variables of a request are checked against, taken from the executed operation so
+// that requests repeating a query are checked without its document.
+type operationVariables struct {
+	// NOTE: Errors which do not depend on the variables, the operation could not be selected or uses variables
+	// it does not define
+	selectionError string
+	undefined      []string
+	definitions    []variableDefinition
+	byOperation    string
+}
+
+type variableDefinition struct {
+	name     string
+	typeName string
+	// NOTE: Non-null without a default value
+	required bool
+}
+
+// extractOperationVariables collects the variables declared by the operation selected by the request and the
+// errors of the variables it uses, directly or through fragments, without declaring them. The document must not
+// contain fragment cycles.
+func extractOperationVariables(astDoc *ast.Document, request graphqlRequest) operationVariables {
+	operation, errorMessage := request.selectOperation(astDoc)
+	if errorMessage != "" {
+		return operationVariables{selectionError: errorMessage}
+	}
+
+	extracted := operationVariables{byOperation: byOperation(operation)}
+
+	declared := make(map[string]bool, len(operation.VariableDefinitions))
+	for _, definition := range operation.VariableDefinitions {
+		_, nonNull := definition.Type.(*ast.NonNull)
+
+		declared[definition.Variable.Name.Value] = true
+		extracted.definitions = append(extracted.definitions, variableDefinition{
+			name:     definition.Variable.Name.Value,
+			typeName: normalizeType(definition.Type),
+			required: nonNull && definition.DefaultValue == nil,
+		})
+	}
+
+	usages := &variableUsages{
+		seen:             make(map[string]bool),
+		fragments:        fragmentDefinitions(astDoc),
+		visitedFragments: make(map[string]bool),
+	}
+	usages.collectSelectionSet(operation.SelectionSet)
+	usages.collectDirectives(operation.Directives)
+
+	for _, name := range usages.names {
+		if !declared[name] {
+			extracted.undefined = append(extracted.undefined,
+				fmt.Sprintf("Variable \"$%s\" is not defined%s.", name, extracted.byOperation))
+		}
+	}
+
+	return extracted
+}
+
+// validate checks that the variables used by the operation are declared, that required variables are provided
+// and that no undeclared variable is provided. The error messages are worded like the reference implementation.
+func (operation operationVariables) validate(request graphqlRequest) []string {
+	if operation.selectionError != "" {
+		return []string{operation.selectionError}
+	}
+
+	variables, err := request.decodeVariables()
+	if err != nil {
+		return []string{"Variables must be a JSON object."}
+	}
+
+	errorMessages := append([]string(nil), operation.undefined...)
+
+	declared := make(map[string]bool, len(operation.definitions))
+	for _, definition := range operation.definitions {
+		declared[definition.name] = true
+
+		if !definition.required {
+			continue
+		}
+
+		value, provided := variables[definition.name]
+		switch {
+		case !provided:
+			errorMessages = append(errorMessages, fmt.Sprintf("Variable \"$%s\" of required type %q was not provided.",
+				definition.name, definition.typeName))
+		case value == nil:
+			errorMessages = append(errorMessages, fmt.Sprintf("Variable \"$%s\" of non-null type %q must not be null.",
+				definition.name, definition.typeName))
+		}
+	}
+
+	provided := make([]string, 0, len(variables))
+	for name := range variables {
+		provided = append(provided, name)
+	}
+	sort.Strings(provided)
+
+	for _, name := range provided {
+		if !declared[name] {
+			errorMessages = append(errorMessages, fmt.Sprintf("Variable \"$%s\" is not declared%s.", name, operation.byOperation))
+		}
+	}
+
+	return errorMessages
+}
+
+func byOperation(operation *ast.OperationDefinition) string {
+	if operation.Name == nil {
+		return ""
+	}
+
+	return fmt.Sprintf(" by operation %q", operation.Name.Value)
+}
+
+// variableUsages collects the names of the variables used in a selection set, in order of first use.
+type variableUsages struct {
+	names            []string
+	seen             map[string]bool
+	fragments        map[string]*ast.FragmentDefinition
+	visitedFragments map[string]bool
+}
+
+func (usages *variableUsages) collectSelectionSet(selectionSet *ast.SelectionSet) {
+	if selectionSet == nil {
+		return
+	}
+
+	for _, selection := range selectionSet.Selections {
+		switch node := selection.(type) {
+		case *ast.Field:
+			usages.collectArguments(node.Arguments)
+			usages.collectDirectives(node.Directives)
+			usages.collectSelectionSet(node.SelectionSet)
+		case *ast.InlineFragment:
+			usages.collectDirectives(node.Directives)
+			usages.collectSelectionSet(node.SelectionSet)
+		case *ast.FragmentSpread:
+			usages.collectDirectives(node.Directives)
+
+			fragment, ok := usages.fragments[node.Name.Value]
+			if !ok || usages.visitedFragments[node.Name.Value] {
+				continue
+			}
+			usages.visitedFragments[node.Name.Value] = true
+
+			usages.collectDirectives(fragment.Directives)
+			usages.collectSelectionSet(fragment.SelectionSet)
+		}
+	}
+}
+
+func (usages *variableUsages) collectDirectives(directives []*ast.Directive) {
+	for _, directive := range directives {
+		usages.collectArguments(directive.Arguments)
+	}
+}
+
+func (usages *variableUsages) collectArguments(arguments []*ast.Argument) {
+	for _, argument := range arguments {
+		usages.collectValue(argument.Value)
+	}
+}
+
+func (usages *variableUsages) collectValue(value ast.Value) {
+	switch node := value.(type) {
+	case *ast.Variable:
+		if !usages.seen[node.Name.Value] {
+			usages.seen[node.Name.Value] = true
+			usages.names = append(usages.names, node.Name.Value)
+		}
+	case *ast.ListValue:
+		for _, item := range node.Values {
+			usages.collectValue(item)
+		}
+	case *ast.ObjectValue:
+		for _, field := range node.Fields {
+			usages.collectValue(field.Value)
+		}
+	}
+}
+
+// validateRequestVariables validates the variables of the operation selected by the request.
+func validateRequestVariables(astDoc *ast.Document, request graphqlRequest) []string {
+	return extractOperationVariables(astDoc, request).validate(request)
+}
@@ -0,0 +1,90 @@
+package traefikgraphqllimits
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+func validateTestRequestVariables(t *testing.T, body string) []string {
+	t.Helper()
+
+	request := parseGraphqlRequest([]byte(body))
+
+	astDoc, err := parser.Parse(parser.ParseParams{Source: request.Query})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return validateRequestVariables(astDoc, request)
+}
+
+func TestValidateVariablesValid(t *testing.T) {
+	body := `{
+    "query": "query GetUser($id: ID!, $page: Int = 1, $withEmail: Boolean) { user(id: $id) { ...userFields } } fragment userFields on User { name email @include(if: $withEmail) friends(filter: {page: [$page]}) { name } }",
+    "variables": {"id": "1", "withEmail": null}
+  }`
+
+	errorMessages := validateTestRequestVariables(t, body)
+	if len(errorMessages) > 0 {
+		t.Errorf("unexpected validation errors: %v", errorMessages)
+	}
+}
+
+func TestValidateVariablesInvalid(t *testing.T) {
+	body := `{
+    "query": "query GetUser($id: ID!, $ids: [ID!]!, $unused: String) { user(id: $id, page: $page) { name } users(ids: $ids) { name } }",
+    "variables": {"id": null, "extra": 1}
+  }`
+
+	expected := []string{
+		`Variable "$page" is not defined by operation "GetUser".`,
+		`Variable "$id" of non-null type "ID!" must not be null.`,
+		`Variable "$ids" of required type "[ID!]!" was not provided.`,
+		`Variable "$extra" is not declared by operation "GetUser".`,
+	}
+
+	errorMessages := validateTestRequestVariables(t, body)
+	if !reflect.DeepEqual(errorMessages, expected) {
+		t.Errorf("unexpected validation errors:\n got: %q\nwant: %q", errorMessages, expected)
+	}
+}
+
+func TestValidateVariablesSelectedOperation(t *testing.T) {
+	query := `query A($id: ID!) { user(id: $id) { name } } query B { users { name } }`
+
+	errorMessages := validateTestRequestVariables(t, `{"query": "`+query+`", "operationName": "B"}`)
+	if len(errorMessages) > 0 {
+		t.Errorf("unexpected validation errors: %v", errorMessages)
+	}
+
+	errorMessages = validateTestRequestVariables(t, `{"query": "`+query+`", "operationName": "C"}`)
+	if !reflect.DeepEqual(errorMessages, []string{`Unknown operation named "C".`}) {
+		t.Errorf("unexpected validation errors: %q", errorMessages)
+	}
+
+	errorMessages = validateTestRequestVariables(t, query)
+	if !reflect.DeepEqual(errorMessages, []string{"Must provide operation name if query contains multiple operations."}) {
+		t.Errorf("unexpected validation errors: %q", errorMessages)
+	}
+}
+
+func TestGraphqlValidateVariablesFailed(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ValidateVariables = true
+
+	body := `{"query": "query GetUser($id: ID!) { user(id: $id) { name } }", "variables": {}}`
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusBadRequest)
+}
+
+func TestGraphqlValidateVariablesPassed(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ValidateVariables = true
+
+	body := `{"query": "query GetUser($id: ID!) { user(id: $id) { name } }", "variables": {"id": 1}}`
+
+	RunGraphqlLimitsTest(t, cfg, body, http.StatusOK)
+}
@@ -0,0 +1,686 @@
+package traefikgraphqllimits
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// WebSocket sub-protocols used to run GraphQL operations, mostly subscriptions.
+const (
+	// graphqlTransportWSProtocol the protocol of the graphql-ws library, operations are sent as `subscribe`.
+	graphqlTransportWSProtocol = "graphql-transport-ws"
+	// graphqlWSProtocol the legacy protocol of subscriptions-transport-ws, operations are sent as `start`.
+	graphqlWSProtocol = "graphql-ws"
+)
+
+// WebSocket frame opcodes, see RFC 6455 section 5.2.
+const (
+	opcodeContinuation = 0x0
+	opcodeText         = 0x1
+	opcodeClose        = 0x8
+)
+
+const (
+	closeMessageTooBig = 1009
+	// NOTE: Size of the text messages which are inspected when MaxBodyBytes is not set
+	defaultMaxWebSocketMessageBytes = 1024 * 1024
+	// NOTE: RFC 6455 section 5.5
+	maxControlFramePayload = 125
+	// NOTE: Upgrade responses are small, anything larger is not inspected
+	maxHandshakeBytes = 16 * 1024
+	// NOTE: Messages ending an operation are small, larger server messages are not decoded
+	maxServerMessageBytes = 64 * 1024
+)
+
+// webSocketProtocolMessages the types of the client messages starting and stopping an operation. In both
+// protocols, the server ends an operation with a `complete` or `error` message.
+type webSocketProtocolMessages struct {
+	start string
+	stop  string
+}
+
+var graphqlWebSocketProtocols = map[string]webSocketProtocolMessages{
+	graphqlTransportWSProtocol: {start: "subscribe", stop: "complete"},
+	graphqlWSProtocol:          {start: "start", stop: "stop"},
+}
+
+var (
+	errNotHijacker          = errors.New("response writer does not support hijacking")
+	errWebSocketMessageSize = errors.New("websocket message too large")
+	errWebSocketFrame       = errors.New("invalid websocket frame")
+	errSubscriptionLimit    = errors.New("too many active subscriptions")
+)
+
+// webSocketMessage a message of the GraphQL over WebSocket protocols.
+type webSocketMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+func isWebSocketUpgrade(req *http.Request) bool {
+	return req.Method == http.MethodGet &&
+		headerContainsToken(req.Header, "Connection", "upgrade") &&
+		headerContainsToken(req.Header, "Upgrade", "websocket")
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// webSocketResponseWriter hands next a connection inspecting GraphQL messages when it hijacks the upgrade.
+type webSocketResponseWriter struct {
+	http.ResponseWriter
+	limit *GraphqlLimit
+	req   *http.Request
+}
+
+func (w *webSocketResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errNotHijacker
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// NOTE: Reading through the hijacked reader keeps the client bytes it already buffered
+	graphqlConn := &graphqlWebSocketConn{
+		Conn:       conn,
+		reader:     brw.Reader,
+		limit:      w.limit,
+		req:        w.req,
+		client:     w.limit.subscriptionLimits.clientID(w.req),
+		operations: make(map[string]bool),
+		outbound:   outboundStream{decodeMessages: w.limit.subscriptionLimits.isEnabled()},
+	}
+
+	return graphqlConn, bufio.NewReadWriter(bufio.NewReader(graphqlConn), bufio.NewWriter(graphqlConn)), nil
+}
+
+// graphqlWebSocketConn the client side of an upgraded connection. Messages from the client starting a GraphQL
+// operation are checked against the limits and replaced by an error message sent back to the client when
+// they violate one. Everything else, including the frames written by next, goes through unchanged.
+// Operations are active from their start message until the client stops them or the server ends them, the
+// connection is closed when starting one exceeds the subscription limits.
+type graphqlWebSocketConn struct {
+	net.Conn
+	reader io.Reader
+	limit  *GraphqlLimit
+	req    *http.Request
+	client string
+
+	// NOTE: Client frames ready to be read by next
+	pending bytes.Buffer
+	// NOTE: Payload bytes of a frame which is not inspected, read by next straight from the client after pending
+	passthrough int64
+	// NOTE: Fragments of the client message being received, only buffered for text messages
+	message       []byte
+	messageFrames []byte
+	messageSize   int64
+	fragmentsText bool
+
+	mu       sync.Mutex
+	outbound outboundStream
+	// NOTE: Frames sent to the client while next was in the middle of writing a frame
+	queued     []byte
+	operations map[string]bool
+	closeOnce  sync.Once
+	closed     bool
+}
+
+func (c *graphqlWebSocketConn) Read(p []byte) (int, error) {
+	for c.pending.Len() == 0 {
+		if c.passthrough > 0 {
+			if int64(len(p)) > c.passthrough {
+				p = p[:c.passthrough]
+			}
+
+			n, err := c.reader.Read(p)
+			c.passthrough -= int64(n)
+			if errors.Is(err, io.EOF) && c.passthrough > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+
+			return n, err
+		}
+
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	return c.pending.Read(p)
+}
+
+// maxMessageBytes the size of the largest text message buffered to be inspected.
+func (c *graphqlWebSocketConn) maxMessageBytes() int64 {
+	if c.limit.maxBodyBytes > 0 {
+		return c.limit.maxBodyBytes
+	}
+
+	return defaultMaxWebSocketMessageBytes
+}
+
+func (c *graphqlWebSocketConn) readFrame() error {
+	header, err := readWebSocketFrameHeader(c.reader)
+	if err != nil {
+		return err
+	}
+
+	opcode := header[0] & 0x0f
+	length := int64(framePayloadLength(header))
+
+	// NOTE: Control frames can be interleaved with the fragments of a message
+	if opcode >= opcodeClose {
+		if length > maxControlFramePayload {
+			return errWebSocketFrame
+		}
+
+		c.passFrame(header, length)
+		return nil
+	}
+
+	if opcode != opcodeContinuation {
+		c.fragmentsText = opcode == opcodeText
+		c.messageSize = 0
+	}
+
+	// NOTE: Only text messages carry GraphQL operations, other frames are never buffered
+	if !c.fragmentsText {
+		c.passFrame(header, length)
+		return nil
+	}
+
+	if length > c.maxMessageBytes()-c.messageSize {
+		_ = c.send(encodeWebSocketFrame(opcodeClose, closePayload(closeMessageTooBig, "Message too big")))
+		return errWebSocketMessageSize
+	}
+
+	frame, err := readWebSocketFramePayload(c.reader, header)
+	if err != nil {
+		return err
+	}
+
+	c.messageSize += length
+
+	c.message = append(c.message, frame.payload...)
+	c.messageFrames = append(c.messageFrames, frame.raw...)
+
+	if !frame.fin {
+		return nil
+	}
+
+	allowed, err := c.allowMessage(c.message)
+	if allowed {
+		c.pending.Write(c.messageFrames)
+	}
+
+	c.message, c.messageFrames = nil, nil
+
+	return err
+}
+
+// passFrame hands a frame which is not inspected to next, its payload is streamed from the client.
+func (c *graphqlWebSocketConn) passFrame(header []byte, length int64) {
+	c.pending.Write(header)
+	c.passthrough = length
+}
+
+// allowMessage checks the operation started by a client message, sending an error message to the client
+// when it is rejected. Messages which are not understood are left to next. An error is returned when the
+// connection has to be closed.
+func (c *graphqlWebSocketConn) allowMessage(data []byte) (bool, error) {
+	protocol := c.protocol()
+
+	messages, ok := graphqlWebSocketProtocols[protocol]
+	if !ok {
+		return true, nil
+	}
+
+	var message webSocketMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return true, nil
+	}
+
+	switch message.Type {
+	case messages.stop:
+		c.endOperation(message.ID)
+		return true, nil
+	case messages.start:
+	default:
+		return true, nil
+	}
+
+	request, err := decodeGraphqlRequest(message.Payload)
+	if errors.Is(err, errAmbiguousRequest) {
+		request = graphqlRequest{ambiguous: true}
+	} else if err != nil {
+		return true, nil
+	}
+
+	if violation := c.limit.checkRequest(c.req, request); violation != nil {
+		if err := c.send(encodeWebSocketFrame(opcodeText, buildWebSocketError(protocol, message.ID, violation))); err != nil {
+			log.Printf("Error with websocket response: %v", err)
+		}
+
+		return false, nil
+	}
+
+	if !c.startOperation(message.ID) {
+		closeCode := uint16(c.limit.subscriptionLimits.closeCode)
+		if err := c.send(encodeWebSocketFrame(opcodeClose, closePayload(closeCode, "Too many subscriptions"))); err != nil {
+			log.Printf("Error with websocket response: %v", err)
+		}
+
+		return false, errSubscriptionLimit
+	}
+
+	return true, nil
+}
+
+// startOperation marks an operation as active, returning false when it exceeds the subscription limits.
+func (c *graphqlWebSocketConn) startOperation(id string) bool {
+	limits := c.limit.subscriptionLimits
+	if !limits.isEnabled() {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// NOTE: Reusing the id of an active operation is a protocol error left to next, and nothing reaches next
+	// anymore once the connection is closed
+	if c.operations[id] || c.closed {
+		return true
+	}
+
+	if limits.perConnection > 0 && len(c.operations) >= limits.perConnection {
+		return false
+	}
+
+	if !limits.acquire(c.client) {
+		return false
+	}
+
+	c.operations[id] = true
+
+	return true
+}
+
+func (c *graphqlWebSocketConn) endOperation(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.endOperationLocked(id)
+}
+
+func (c *graphqlWebSocketConn) endOperationLocked(id string) {
+	if c.operations[id] {
+		delete(c.operations, id)
+		c.limit.subscriptionLimits.release(c.client, 1)
+	}
+}
+
+// endServerOperation ends the operation of a `complete` or `error` message sent by the server.
+func (c *graphqlWebSocketConn) endServerOperation(data []byte) {
+	var message webSocketMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return
+	}
+
+	if message.Type == "complete" || message.Type == "error" {
+		c.endOperationLocked(message.ID)
+	}
+}
+
+// Close closes the connection and releases the operations still active on it.
+func (c *graphqlWebSocketConn) Close() error {
+	// NOTE: Closed before taking mu, which Write holds while it is blocked on a client that stopped reading
+	err := c.Conn.Close()
+
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.limit.subscriptionLimits.release(c.client, len(c.operations))
+		c.operations = make(map[string]bool)
+		c.closed = true
+	})
+
+	return err
+}
+
+// buildWebSocketError turns the errors of a rejected request into an `error` message of the protocol, the
+// legacy protocol only carries a single error.
+func buildWebSocketError(protocol, id string, violation *limitViolation) []byte {
+	var response struct {
+		Errors []json.RawMessage `json:"errors"`
+	}
+	_ = json.Unmarshal([]byte(violation.body), &response)
+
+	var payload interface{} = response.Errors
+	if protocol == graphqlWSProtocol && len(response.Errors) > 0 {
+		payload = response.Errors[0]
+	}
+
+	encodedPayload, _ := json.Marshal(payload)
+	message, _ := json.Marshal(webSocketMessage{ID: id, Type: "error", Payload: encodedPayload})
+
+	return message
+}
+
+func (c *graphqlWebSocketConn) protocol() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.outbound.protocol
+}
+
+func (c *graphqlWebSocketConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// NOTE: Operations end before the client can see it, a partial write breaks the connection anyway
+	for _, message := range c.outbound.advance(p) {
+		c.endServerOperation(message)
+	}
+
+	n, err := c.Conn.Write(p)
+
+	if err == nil && len(c.queued) > 0 && c.outbound.atFrameBoundary() {
+		_, err = c.Conn.Write(c.queued)
+		c.queued = nil
+	}
+
+	return n, err
+}
+
+// send writes a frame to the client, waiting for next to finish the frame it is writing.
+func (c *graphqlWebSocketConn) send(frame []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.outbound.atFrameBoundary() {
+		c.queued = append(c.queued, frame...)
+		return nil
+	}
+
+	_, err := c.Conn.Write(frame)
+
+	return err
+}
+
+// outboundStream follows the bytes written to the client to know the negotiated protocol and where frames end.
+// With decodeMessages, the text messages written are also returned by advance.
+type outboundStream struct {
+	handshake      []byte
+	handshakeDone  bool
+	protocol       string
+	header         []byte
+	remaining      uint64
+	decodeMessages bool
+	// NOTE: Opcode of the frame being written and whether it ends its message
+	opcode      byte
+	fin         bool
+	textMessage bool
+	message     []byte
+	truncated   bool
+}
+
+func (s *outboundStream) atFrameBoundary() bool {
+	return s.handshakeDone && len(s.header) == 0 && s.remaining == 0
+}
+
+func (s *outboundStream) advance(data []byte) [][]byte {
+	if !s.handshakeDone {
+		s.handshake = append(s.handshake, data...)
+
+		end := bytes.Index(s.handshake, []byte("\r\n\r\n"))
+		if end < 0 {
+			if len(s.handshake) > maxHandshakeBytes {
+				s.handshake = nil
+			}
+
+			return nil
+		}
+
+		data = s.handshake[end+4:]
+		s.handshakeDone = true
+		s.protocol = handshakeProtocol(s.handshake[:end+4])
+		s.handshake = nil
+	}
+
+	var messages [][]byte
+
+	for len(data) > 0 {
+		if s.remaining > 0 {
+			n := s.remaining
+			if uint64(len(data)) < n {
+				n = uint64(len(data))
+			}
+
+			s.collect(data[:n])
+			s.remaining -= n
+			data = data[n:]
+		} else {
+			s.header = append(s.header, data[0])
+			data = data[1:]
+
+			if len(s.header) < 2 || len(s.header) < frameHeaderSize(s.header) {
+				continue
+			}
+
+			s.startFrame()
+		}
+
+		if s.remaining == 0 && len(s.header) == 0 {
+			if message := s.endFrame(); message != nil {
+				messages = append(messages, message)
+			}
+		}
+	}
+
+	return messages
+}
+
+func (s *outboundStream) startFrame() {
+	s.remaining = framePayloadLength(s.header)
+	s.opcode = s.header[0] & 0x0f
+	s.fin = s.header[0]&0x80 != 0
+
+	if s.opcode != opcodeContinuation && s.opcode < opcodeClose {
+		s.textMessage = s.opcode == opcodeText && s.decodeMessages && s.header[1]&0x80 == 0
+		s.message = s.message[:0]
+		s.truncated = false
+	}
+
+	s.header = s.header[:0]
+}
+
+func (s *outboundStream) collect(payload []byte) {
+	if !s.textMessage || s.opcode >= opcodeClose || s.truncated {
+		return
+	}
+
+	if len(s.message)+len(payload) > maxServerMessageBytes {
+		s.truncated = true
+		return
+	}
+
+	s.message = append(s.message, payload...)
+}
+
+// endFrame returns the text message completed by the frame, or nil.
+func (s *outboundStream) endFrame() []byte {
+	if !s.fin || !s.textMessage || s.opcode >= opcodeClose || s.truncated {
+		return nil
+	}
+
+	s.textMessage = false
+
+	return append([]byte(nil), s.message...)
+}
+
+// handshakeProtocol reads the sub-protocol selected by the upgrade response.
+func handshakeProtocol(handshake []byte) string {
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(handshake)), nil)
+	if err != nil || res.StatusCode != http.StatusSwitchingProtocols {
+		return ""
+	}
+
+	return res.Header.Get("Sec-WebSocket-Protocol")
+}
+
+// webSocketFrame a frame as received, with its unmasked payload.
+type webSocketFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+	raw     []byte
+}
+
+// frameHeaderSize returns the size of a frame header from its first two bytes.
+func frameHeaderSize(header []byte) int {
+	size := 2
+
+	switch header[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+
+	if header[1]&0x80 != 0 {
+		size += 4
+	}
+
+	return size
+}
+
+func framePayloadLength(header []byte) uint64 {
+	switch length := header[1] & 0x7f; length {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(header[2:10])
+	default:
+		return uint64(length)
+	}
+}
+
+// readWebSocketFrame reads a whole frame, failing with errWebSocketMessageSize when its payload is larger than
+// maxPayload. A negative maxPayload disables the check.
+func readWebSocketFrame(reader io.Reader, maxPayload int64) (*webSocketFrame, error) {
+	header, err := readWebSocketFrameHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxPayload >= 0 && framePayloadLength(header) > uint64(maxPayload) {
+		return nil, errWebSocketMessageSize
+	}
+
+	return readWebSocketFramePayload(reader, header)
+}
+
+// readWebSocketFrameHeader reads the header of a frame, failing with errWebSocketFrame when its payload length
+// is invalid.
+func readWebSocketFrameHeader(reader io.Reader) ([]byte, error) {
+	header := make([]byte, 2, 14)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	header = header[:frameHeaderSize(header)]
+	if _, err := io.ReadFull(reader, header[2:]); err != nil {
+		return nil, err
+	}
+
+	if framePayloadLength(header) > math.MaxInt64 {
+		return nil, errWebSocketFrame
+	}
+
+	return header, nil
+}
+
+// readWebSocketFramePayload reads the payload of a frame after its header.
+func readWebSocketFramePayload(reader io.Reader, header []byte) (*webSocketFrame, error) {
+	var payload bytes.Buffer
+	if _, err := io.CopyN(&payload, reader, int64(framePayloadLength(header))); err != nil {
+		return nil, err
+	}
+
+	frame := &webSocketFrame{
+		fin:     header[0]&0x80 != 0,
+		opcode:  header[0] & 0x0f,
+		payload: payload.Bytes(),
+		raw:     append(header, payload.Bytes()...),
+	}
+
+	if header[1]&0x80 != 0 {
+		maskKey := header[len(header)-4:]
+
+		frame.payload = make([]byte, payload.Len())
+		for i, b := range payload.Bytes() {
+			frame.payload[i] = b ^ maskKey[i%4]
+		}
+	}
+
+	return frame, nil
+}
+
+// encodeWebSocketFrame encodes an unfragmented and unmasked frame, as sent by a server.
+func encodeWebSocketFrame(opcode byte, payload []byte) []byte {
+	frame := []byte{0x80 | opcode}
+
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, byte(length))
+	case length <= math.MaxUint16:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	return append(frame, payload...)
+}
+
+// isValidCloseCode reports whether a close code can be sent in a close frame, codes reserved by RFC 6455 for
+// endpoints to report a missing status or an abnormal closure are not.
+func isValidCloseCode(code int) bool {
+	switch {
+	case code < 1000 || code > 4999:
+		return false
+	case code >= 1004 && code <= 1006, code == 1015:
+		return false
+	}
+
+	return true
+}
+
+func closePayload(code uint16, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, code), reason...)
+}
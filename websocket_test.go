@@ -0,0 +1,408 @@
+package traefikgraphqllimits
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// webSocketEchoHandler completes the upgrade and echoes every text message, as a GraphQL server answering
+// each operation would.
+func webSocketEchoHandler(protocol string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, brw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		_, _ = fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Protocol: %s\r\n\r\n", protocol)
+		_ = brw.Flush()
+
+		for {
+			frame, err := readWebSocketFrame(brw.Reader, -1)
+			if err != nil || frame.opcode == opcodeClose {
+				return
+			}
+
+			_, _ = conn.Write(encodeWebSocketFrame(opcodeText, frame.payload))
+		}
+	})
+}
+
+type webSocketTestClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func startWebSocketTestServer(t *testing.T, cfg *Config, protocol string) string {
+	t.Helper()
+
+	handler, err := New(context.Background(), webSocketEchoHandler(protocol), cfg, "traefik-graphql-limits-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func dialWebSocketTest(t *testing.T, address, protocol string) *webSocketTestClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = fmt.Fprintf(conn, "GET /graphql HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Protocol: %s\r\n"+
+		"X-Client-Id: test-client\r\n\r\n", protocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status code %d, got %d", http.StatusSwitchingProtocols, res.StatusCode)
+	}
+
+	return &webSocketTestClient{t: t, conn: conn, reader: reader}
+}
+
+// send writes a message as masked client frames, split in fragments of at most fragmentSize bytes.
+func (client *webSocketTestClient) send(message string, fragmentSize int) {
+	client.t.Helper()
+
+	maskKey := []byte{0x12, 0x34, 0x56, 0x78}
+
+	for offset := 0; offset < len(message); offset += fragmentSize {
+		end := offset + fragmentSize
+		if end > len(message) {
+			end = len(message)
+		}
+		fragment := message[offset:end]
+
+		opcode := byte(opcodeContinuation)
+		if offset == 0 {
+			opcode = opcodeText
+		}
+		if end == len(message) {
+			opcode |= 0x80
+		}
+
+		frame := []byte{opcode, 0x80 | 126, byte(len(fragment) >> 8), byte(len(fragment))}
+		frame = append(frame, maskKey...)
+		for i := 0; i < len(fragment); i++ {
+			frame = append(frame, fragment[i]^maskKey[i%4])
+		}
+
+		if _, err := client.conn.Write(frame); err != nil {
+			client.t.Fatal(err)
+		}
+	}
+}
+
+func (client *webSocketTestClient) receive() webSocketMessage {
+	client.t.Helper()
+
+	frame, err := readWebSocketFrame(client.reader, -1)
+	if err != nil {
+		client.t.Fatal(err)
+	}
+
+	var message webSocketMessage
+	if err := json.Unmarshal(frame.payload, &message); err != nil {
+		client.t.Fatalf("unexpected frame %q: %v", frame.payload, err)
+	}
+
+	return message
+}
+
+func (client *webSocketTestClient) expectClose(code int) {
+	client.t.Helper()
+
+	frame, err := readWebSocketFrame(client.reader, -1)
+	if err != nil {
+		client.t.Fatal(err)
+	}
+
+	if frame.opcode != opcodeClose || len(frame.payload) < 2 || int(frame.payload[0])<<8|int(frame.payload[1]) != code {
+		client.t.Errorf("expected a close frame with code %d, got opcode %d and payload %q", code, frame.opcode, frame.payload)
+	}
+}
+
+const (
+	deepSubscription    = `{"query":"subscription ` + deepSelection + `"}`
+	shallowSubscription = `{"query":"subscription { user { name } }"}`
+)
+
+func TestWebSocketSubscriptionLimits(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DepthLimit = 2
+
+	client := dialWebSocketTest(t, startWebSocketTestServer(t, cfg, graphqlTransportWSProtocol), graphqlTransportWSProtocol)
+
+	client.send(`{"type":"connection_init"}`, 1024)
+	client.send(`{"id":"1","type":"subscribe","payload":`+deepSubscription+`}`, 16)
+	client.send(`{"id":"2","type":"subscribe","payload":`+shallowSubscription+`}`, 1024)
+
+	if message := client.receive(); message.Type != "connection_init" {
+		t.Errorf("expected connection_init to be forwarded, got %q", message.Type)
+	}
+
+	message := client.receive()
+	if message.Type != "error" || message.ID != "1" {
+		t.Fatalf("expected an error for subscription 1, got %q for %q", message.Type, message.ID)
+	}
+
+	var errors []map[string]interface{}
+	if err := json.Unmarshal(message.Payload, &errors); err != nil || len(errors) != 1 {
+		t.Fatalf("expected a list of one error, got %s", message.Payload)
+	}
+
+	if message := client.receive(); message.Type != "subscribe" || message.ID != "2" {
+		t.Errorf("expected subscription 2 to be forwarded, got %q for %q", message.Type, message.ID)
+	}
+}
+
+func TestWebSocketAmbiguousPayload(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DepthLimit = 2
+
+	client := dialWebSocketTest(t, startWebSocketTestServer(t, cfg, graphqlTransportWSProtocol), graphqlTransportWSProtocol)
+
+	client.send(`{"id":"1","type":"subscribe","payload":{"query":"subscription `+deepSelection+`",`+
+		`"Query":"subscription { user { name } }"}}`, 1024)
+
+	if message := client.receive(); message.Type != "error" || message.ID != "1" {
+		t.Errorf("expected an error for subscription 1, got %q for %q", message.Type, message.ID)
+	}
+}
+
+func TestWebSocketLegacyProtocolLimits(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.NodeLimit = 2
+
+	client := dialWebSocketTest(t, startWebSocketTestServer(t, cfg, graphqlWSProtocol), graphqlWSProtocol)
+
+	client.send(`{"id":"1","type":"start","payload":`+deepSubscription+`}`, 1024)
+	client.send(`{"id":"2","type":"start","payload":`+shallowSubscription+`}`, 1024)
+
+	message := client.receive()
+	if message.Type != "error" || message.ID != "1" {
+		t.Fatalf("expected an error for subscription 1, got %q for %q", message.Type, message.ID)
+	}
+
+	var graphqlError map[string]interface{}
+	if err := json.Unmarshal(message.Payload, &graphqlError); err != nil || graphqlError["message"] == nil {
+		t.Fatalf("expected a single error, got %s", message.Payload)
+	}
+
+	if message := client.receive(); message.Type != "start" || message.ID != "2" {
+		t.Errorf("expected subscription 2 to be forwarded, got %q for %q", message.Type, message.ID)
+	}
+}
+
+func TestWebSocketMessageTooLarge(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxBodyBytes = 32
+
+	client := dialWebSocketTest(t, startWebSocketTestServer(t, cfg, graphqlTransportWSProtocol), graphqlTransportWSProtocol)
+
+	client.send(`{"id":"1","type":"subscribe","payload":`+shallowSubscription+`}`, 16)
+
+	client.expectClose(closeMessageTooBig)
+}
+
+func TestWebSocketDefaultMessageSize(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DepthLimit = 2
+
+	client := dialWebSocketTest(t, startWebSocketTestServer(t, cfg, graphqlTransportWSProtocol), graphqlTransportWSProtocol)
+
+	// NOTE: Only the header is sent, the message is rejected from its declared length
+	header := []byte{0x80 | opcodeText, 0x80 | 127}
+	header = binary.BigEndian.AppendUint64(header, defaultMaxWebSocketMessageBytes+1)
+	header = append(header, 0x12, 0x34, 0x56, 0x78)
+
+	if _, err := client.conn.Write(header); err != nil {
+		t.Fatal(err)
+	}
+
+	client.expectClose(closeMessageTooBig)
+}
+
+func TestWebSocketBinaryFramesStreamed(t *testing.T) {
+	header := []byte{0x80 | 0x2, 127}
+	header = binary.BigEndian.AppendUint64(header, 1<<40)
+
+	conn := &graphqlWebSocketConn{
+		reader: io.MultiReader(bytes.NewReader(header), strings.NewReader("binary")),
+		limit:  &GraphqlLimit{},
+	}
+
+	buffer := make([]byte, 1024)
+
+	n, err := conn.Read(buffer)
+	if err != nil || !bytes.Equal(buffer[:n], header) {
+		t.Fatalf("expected the frame header, got %q: %v", buffer[:n], err)
+	}
+
+	n, err = conn.Read(buffer)
+	if err != nil || string(buffer[:n]) != "binary" {
+		t.Fatalf("expected the payload read so far, got %q: %v", buffer[:n], err)
+	}
+
+	if _, err = conn.Read(buffer); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected the truncated payload to fail, got %v", err)
+	}
+}
+
+func TestOutboundStreamFrameBoundaries(t *testing.T) {
+	var stream outboundStream
+
+	stream.advance([]byte("HTTP/1.1 101 Switching Protocols\r\nSec-WebSocket-Protocol: graphql-ws\r\n"))
+	if stream.atFrameBoundary() {
+		t.Error("expected no frame boundary before the end of the handshake")
+	}
+
+	frame := encodeWebSocketFrame(opcodeText, []byte(strings.Repeat("x", 300)))
+
+	stream.advance(append([]byte("\r\n"), frame[:3]...))
+	if stream.atFrameBoundary() || stream.protocol != graphqlWSProtocol {
+		t.Errorf("expected protocol %q in the middle of a frame, got %q", graphqlWSProtocol, stream.protocol)
+	}
+
+	stream.advance(frame[3:])
+	if !stream.atFrameBoundary() {
+		t.Error("expected a frame boundary after the whole frame")
+	}
+}
+
+func TestWebSocketSubscriptionsPerConnection(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxSubscriptionsPerConnection = 2
+
+	client := dialWebSocketTest(t, startWebSocketTestServer(t, cfg, graphqlTransportWSProtocol), graphqlTransportWSProtocol)
+
+	client.send(`{"id":"1","type":"subscribe","payload":`+shallowSubscription+`}`, 1024)
+	client.send(`{"id":"2","type":"subscribe","payload":`+shallowSubscription+`}`, 1024)
+	client.send(`{"id":"1","type":"complete"}`, 1024)
+	// NOTE: Echoed back, the error is sent by the server and ends subscription 2
+	client.send(`{"id":"2","type":"error","payload":[]}`, 1024)
+
+	for _, expected := range []string{"subscribe", "subscribe", "complete", "error"} {
+		if message := client.receive(); message.Type != expected {
+			t.Fatalf("expected %q to be forwarded, got %q", expected, message.Type)
+		}
+	}
+
+	client.send(`{"id":"3","type":"subscribe","payload":`+shallowSubscription+`}`, 1024)
+	client.send(`{"id":"4","type":"subscribe","payload":`+shallowSubscription+`}`, 1024)
+	client.send(`{"id":"5","type":"subscribe","payload":`+shallowSubscription+`}`, 1024)
+
+	for _, expected := range []string{"3", "4"} {
+		if message := client.receive(); message.ID != expected {
+			t.Fatalf("expected subscription %s to be forwarded, got %q", expected, message.ID)
+		}
+	}
+
+	client.expectClose(4429)
+}
+
+func TestWebSocketSubscriptionsPerClient(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxSubscriptionsPerClient = 1
+	cfg.SubscriptionClientHeader = "X-Client-Id"
+	cfg.SubscriptionLimitCloseCode = 4000
+
+	address := startWebSocketTestServer(t, cfg, graphqlWSProtocol)
+	first := dialWebSocketTest(t, address, graphqlWSProtocol)
+	second := dialWebSocketTest(t, address, graphqlWSProtocol)
+
+	first.send(`{"id":"1","type":"start","payload":`+shallowSubscription+`}`, 1024)
+	if message := first.receive(); message.Type != "start" {
+		t.Fatalf("expected the first subscription to be forwarded, got %q", message.Type)
+	}
+
+	second.send(`{"id":"1","type":"start","payload":`+shallowSubscription+`}`, 1024)
+	second.expectClose(4000)
+}
+
+func TestWebSocketCloseWithPendingWrite(t *testing.T) {
+	limits := &subscriptionLimits{perClient: 1, clients: make(map[string]int)}
+	clientConn, proxyConn := net.Pipe()
+	t.Cleanup(func() { _ = clientConn.Close() })
+
+	conn := &graphqlWebSocketConn{
+		Conn:       proxyConn,
+		limit:      &GraphqlLimit{subscriptionLimits: limits},
+		client:     "test-client",
+		operations: make(map[string]bool),
+	}
+	if !conn.startOperation("1") {
+		t.Fatal("expected the operation to start")
+	}
+
+	// NOTE: The client never reads, so the write blocks while holding the lock of the connection
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n\r\n"))
+		written <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() { closed <- conn.Close() }()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Close to return while a write is pending")
+	}
+
+	if err := <-written; err == nil {
+		t.Error("expected the pending write to fail")
+	}
+
+	if len(limits.clients) != 0 {
+		t.Errorf("expected the operations of the connection to be released, got %v", limits.clients)
+	}
+}
+
+func TestInvalidSubscriptionLimitCloseCode(t *testing.T) {
+	for _, closeCode := range []int{0, 999, 1005, 1015, 5000, 70000} {
+		cfg := CreateConfig()
+		cfg.MaxSubscriptionsPerConnection = 1
+		cfg.SubscriptionLimitCloseCode = closeCode
+
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "traefik-graphql-limits-plugin"); err == nil {
+			t.Errorf("expected an error for the close code %d", closeCode)
+		}
+	}
+}